@@ -0,0 +1,272 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/cretz/bine/control"
+)
+
+// restartOptions are the options Tor refuses to change while it is running.
+var restartOptions = map[string]bool{
+	"AccelDir": true, "AccelName": true, "CacheDirectory": true,
+	"DataDirectory": true, "DisableAllSwap": true,
+	"DisableDebuggerAttachment": true, "HardwareAccel": true,
+	"HiddenServiceNonAnonymousMode": true, "HiddenServiceSingleHopMode": true,
+	"KeepBindCapabilities": true, "KeyDirectory": true, "NoExec": true,
+	"PidFile": true, "RunAsDaemon": true, "Sandbox": true,
+	"SyslogIdentityTag": true, "TestingTorNetwork": true,
+	"TokenBucketRefillInterval": true, "User": true,
+}
+
+// hiddenServiceOptions is the name Tor uses for all HiddenService* lines
+// together. Tor replaces them as one group, so they are diffed as one.
+const hiddenServiceOptions = "HiddenServiceOptions"
+
+// OptionChange is a difference between the running and a new configuration.
+type OptionChange struct {
+	// Option is the Tor option name, HiddenServiceOptions for the onion
+	// services, or the Config field name for settings that are not Tor
+	// options, such as Logger
+	Option string
+
+	// Old and New are the option's lines before and after; an empty New
+	// resets the option to Tor's default
+	Old, New []Option
+}
+
+// ApplyResult reports the outcome of Apply.
+type ApplyResult struct {
+	// Applied are the changes Tor has taken
+	Applied []OptionChange
+
+	// RestartRequired are the changes that only take effect when Tor is
+	// started again with the new configuration
+	RestartRequired []OptionChange
+}
+
+// Apply reconfigures Tor on the default instance. See Instance.Apply.
+func Apply(ctx context.Context, config *Config) (*ApplyResult, error) {
+	return defaultInstance.Apply(ctx, config)
+}
+
+// Apply changes the running Tor to config without restarting it. The new
+// configuration is checked, diffed against the running one (the config
+// passed to Start, or Tor's own GETINFO config-text for instances started
+// otherwise, in which case options config does not render are left as
+// they are) and only the options that differ are sent in a single
+// RESETCONF, which resets removed options and sets the rest. Tor applies
+// it entirely or not at all, so when Apply fails the running configuration
+// is unchanged. Changes Tor cannot make while running, such as
+// the data directory or the logger, are left out and reported in
+// RestartRequired. It returns ErrNotRunning if Tor is not running.
+func (i *Instance) Apply(ctx context.Context, config *Config) (*ApplyResult, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	running, err := i.runningConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.Ephemeral {
+		ephemeral := *config
+		ephemeral.DataDir = running.dataDir
+		ephemeral.Directory.AvoidDiskWrites = true
+		config = &ephemeral
+	}
+
+	result := &ApplyResult{}
+	// RESETCONF resets bare keys to their defaults and sets the others,
+	// like SETCONF
+	var entries []*control.KeyVal
+	restart := map[string]bool{}
+	for _, change := range running.diff(config) {
+		if restartOptions[change.Option] || !isTorOption(change.Option) && change.Option != hiddenServiceOptions {
+			result.RestartRequired = append(result.RestartRequired, change)
+			restart[change.Option] = true
+			continue
+		}
+		result.Applied = append(result.Applied, change)
+		if change.Option == "SocksPort" && len(i.tenants) > 0 {
+			// Keep the listeners added by AddSocksListener
+			var own []string
+			for _, opt := range change.New {
+				own = append(own, opt.Value)
+			}
+			for _, line := range withTenantLines(own, i.tenants) {
+				entries = append(entries, control.NewKeyVal("SocksPort", line))
+			}
+			continue
+		}
+		if len(change.New) == 0 {
+			entries = append(entries, &control.KeyVal{Key: change.Option})
+		}
+		for _, opt := range change.New {
+			entries = append(entries, control.NewKeyVal(opt.Key, opt.Value))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		if err := t.Control.ResetConf(entries...); err != nil {
+			return nil, fmt.Errorf("failed to set options: %w", err)
+		}
+	}
+	i.applied.Store(running.update(config, restart))
+	i.onions.syncDirServices(config.OnionServices)
+
+	if len(result.Applied) > 0 && i.listeners.Load() != nil {
+		listeners, err := queryListeners(t.Control)
+		if err != nil {
+			return result, fmt.Errorf("failed to query listeners: %w", err)
+		}
+		i.listeners.Store(listeners)
+	}
+	return result, nil
+}
+
+// appliedConfig is what the running Tor was configured with.
+type appliedConfig struct {
+	dataDir  string
+	logger   *slog.Logger
+	logLevel slog.Level
+	keyStore KeyStore
+
+	// options are the Tor options grouped by groupOptions
+	options map[string][]Option
+	order   []string
+
+	// fromTor is set when options were read back from Tor. They then
+	// include what bine sets itself, such as CookieAuthentication and
+	// DisableNetwork, so options a new config leaves out are not reset.
+	fromTor bool
+}
+
+func newAppliedConfig(config *Config) *appliedConfig {
+	options, order := groupOptions(config.TorOptions())
+	return &appliedConfig{dataDir: config.DataDir, logger: config.Logger,
+		logLevel: config.LogLevel, keyStore: config.KeyStore, options: options, order: order}
+}
+
+// runningConfig returns the configuration stored by Start or Apply, or
+// one read back from Tor.
+func (i *Instance) runningConfig() (*appliedConfig, error) {
+	if applied := i.applied.Load(); applied != nil {
+		return applied, nil
+	}
+	var text strings.Builder
+	if err := i.DumpConfig(&text); err != nil {
+		return nil, err
+	}
+	opts, err := ParseTorrc(strings.NewReader(text.String()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse running config: %w", err)
+	}
+	config, err := ConfigFromOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse running config: %w", err)
+	}
+	running := newAppliedConfig(config)
+	running.fromTor = true
+	return running, nil
+}
+
+// diff returns the changes from a to config, one per option in the order
+// config (then a) renders them.
+func (a *appliedConfig) diff(config *Config) []OptionChange {
+	var changes []OptionChange
+	if a.dataDir != config.DataDir {
+		changes = append(changes, OptionChange{Option: "DataDirectory",
+			Old: []Option{{"DataDirectory", a.dataDir}}, New: []Option{{"DataDirectory", config.DataDir}}})
+	}
+	if a.logger != config.Logger {
+		changes = append(changes, OptionChange{Option: "Logger"})
+	}
+	if a.logLevel != config.LogLevel {
+		changes = append(changes, OptionChange{Option: "LogLevel"})
+	}
+
+	options, order := groupOptions(config.TorOptions())
+	keys := order
+	if !a.fromTor {
+		keys = append(keys, a.order...)
+	}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if !reflect.DeepEqual(a.options[key], options[key]) {
+			changes = append(changes, OptionChange{Option: key, Old: a.options[key], New: options[key]})
+		}
+	}
+	return changes
+}
+
+// update returns the configuration Tor runs after config was applied
+// except for the restart options, which keep their old values.
+func (a *appliedConfig) update(config *Config, restart map[string]bool) *appliedConfig {
+	next := newAppliedConfig(config)
+	next.dataDir, next.logger, next.logLevel = a.dataDir, a.logger, a.logLevel
+	for key := range restart {
+		if old, ok := a.options[key]; ok {
+			if _, ok := next.options[key]; !ok {
+				next.order = append(next.order, key)
+			}
+			next.options[key] = old
+		} else {
+			delete(next.options, key)
+		}
+	}
+	return next
+}
+
+// groupOptions groups opts by canonical option name, collecting all
+// HiddenService* lines under HiddenServiceOptions, and returns the names
+// in order of first appearance. Internal "__" options are skipped.
+func groupOptions(opts []Option) (map[string][]Option, []string) {
+	lines := map[string][]Option{}
+	var order []string
+	for _, opt := range opts {
+		key, ok := canonicalOption(opt.Key)
+		if !ok {
+			key = opt.Key
+		}
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+		group := key
+		if key == "HiddenServiceDir" || perServiceOptions[key] {
+			group = hiddenServiceOptions
+		}
+		if _, ok := lines[group]; !ok {
+			order = append(order, group)
+		}
+		lines[group] = append(lines[group], Option{key, opt.Value})
+	}
+	return lines, order
+}
+
+// isTorOption reports whether name is a Tor option rather than a Config
+// field.
+func isTorOption(name string) bool {
+	_, ok := canonicalOption(name)
+	return ok
+}
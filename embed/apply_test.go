@@ -0,0 +1,147 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyNotRunning(t *testing.T) {
+	if _, err := NewInstance().Apply(context.Background(), nil); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+}
+
+func TestAppliedConfigDiff(t *testing.T) {
+	old := DefaultConfig()
+	old.OnionServices = []OnionServiceConfig{{Dir: "/var/lib/tor/web", Ports: []OnionPort{{Virtual: 80}}}}
+	old.Options = []Option{{"CircuitBuildTimeout", "30"}}
+	running := newAppliedConfig(old)
+
+	config := DefaultConfig()
+	config.DataDir = "/var/lib/other"
+	config.Logger = slog.Default()
+	config.SocksPorts = []Port{{Addr: "9150"}}
+	config.Nodes.ExitNodes = []string{"{de}"}
+	config.OnionServices = []OnionServiceConfig{{Dir: "/var/lib/tor/web", Ports: []OnionPort{{Virtual: 80}, {Virtual: 443}}}}
+	config.Options = []Option{{"hardwareaccel", "1"}}
+
+	var options []string
+	for _, change := range running.diff(config) {
+		options = append(options, change.Option)
+	}
+	want := []string{"DataDirectory", "Logger", "SocksPort", "ExitNodes",
+		"HiddenServiceOptions", "HardwareAccel", "CircuitBuildTimeout"}
+	if !reflect.DeepEqual(options, want) {
+		t.Fatalf("diff() options = %q, want %q", options, want)
+	}
+
+	changes := running.diff(config)
+	if socks := changes[2]; len(socks.Old) != 1 || len(socks.New) != 2 {
+		t.Errorf("Expected all SocksPort lines in the change, got %+v", socks)
+	}
+	if hs := changes[4]; len(hs.New) != 4 || hs.New[0].Key != "HiddenServiceDir" {
+		t.Errorf("Expected the whole onion service block, got %+v", hs)
+	}
+	if cbt := changes[6]; len(cbt.New) != 0 {
+		t.Errorf("Expected a reset of CircuitBuildTimeout, got %+v", cbt)
+	}
+
+	// After applying, only the changes needing a restart remain
+	next := running.update(config, map[string]bool{"DataDirectory": true, "Logger": true, "HardwareAccel": true})
+	options = nil
+	for _, change := range next.diff(config) {
+		options = append(options, change.Option)
+	}
+	want = []string{"DataDirectory", "Logger", "HardwareAccel"}
+	if !reflect.DeepEqual(options, want) {
+		t.Errorf("diff() after update = %q, want %q", options, want)
+	}
+}
+
+func TestApplySingleResetConf(t *testing.T) {
+	old := DefaultConfig()
+	old.Options = []Option{{"CircuitBuildTimeout", "30"}}
+	tr, f := newFakeTor(t, map[string][]string{"CircuitBuildTimeout": {"30"}, "SocksPort": {"9050"}})
+	inst := NewInstance()
+	inst.tor.Store(tr)
+	inst.applied.Store(newAppliedConfig(old))
+
+	config := DefaultConfig()
+	config.Nodes.ExitNodes = []string{"{de}"}
+	result, err := inst.Apply(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 2 {
+		t.Errorf("Expected 2 applied changes, got %+v", result.Applied)
+	}
+	if len(f.commands) != 1 || f.commands[0] != "RESETCONF ExitNodes={de} CircuitBuildTimeout" {
+		t.Errorf("Unexpected commands %q", f.commands)
+	}
+	if f.lines("CircuitBuildTimeout") != nil || !reflect.DeepEqual(f.lines("ExitNodes"), []string{"{de}"}) {
+		t.Errorf("Unexpected Tor configuration %v", f.conf)
+	}
+}
+
+func TestApplyRejected(t *testing.T) {
+	old := DefaultConfig()
+	old.Options = []Option{{"CircuitBuildTimeout", "30"}}
+	tr, f := newFakeTor(t, map[string][]string{"CircuitBuildTimeout": {"30"}})
+	f.reject["ExitNodes"] = true
+	inst := NewInstance()
+	inst.tor.Store(tr)
+	inst.applied.Store(newAppliedConfig(old))
+
+	config := DefaultConfig()
+	config.Nodes.ExitNodes = []string{"{de}"}
+	if _, err := inst.Apply(context.Background(), config); err == nil {
+		t.Fatal("Expected an error when Tor rejects a value")
+	}
+	// Nothing was reset, and the next Apply diffs against the old config
+	if !reflect.DeepEqual(f.lines("CircuitBuildTimeout"), []string{"30"}) {
+		t.Errorf("CircuitBuildTimeout was reset: %v", f.conf)
+	}
+	f.reject = map[string]bool{}
+	f.commands = nil
+	if _, err := inst.Apply(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.commands) != 1 || !strings.Contains(f.commands[0], "CircuitBuildTimeout") {
+		t.Errorf("Expected the reset to be sent again, got %q", f.commands)
+	}
+}
+
+func TestApplyRunningConfigFromTor(t *testing.T) {
+	// Started with StartTor: the configuration is read back from Tor,
+	// including the options bine sets itself
+	tr, f := newFakeTor(t, map[string][]string{})
+	f.info = map[string]string{"config-text": `ControlPort auto
+CookieAuthentication 1
+DataDirectory /var/lib/tor
+DisableNetwork 1
+GeoIPFile /var/lib/tor/geoip
+GeoIPv6File /var/lib/tor/geoip6
+SocksPort 9050
+ExitNodes {us}`}
+	inst := NewInstance()
+	inst.tor.Store(tr)
+
+	config := DefaultConfig()
+	config.DataDir = "/var/lib/tor"
+	config.ClientOnly = false
+	config.Nodes.ExitNodes = []string{"{de}"}
+	result, err := inst.Apply(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 || result.Applied[0].Option != "ExitNodes" {
+		t.Errorf("Expected only ExitNodes to change, got %+v", result.Applied)
+	}
+	if len(f.commands) != 2 || f.commands[1] != "RESETCONF ExitNodes={de}" {
+		t.Errorf("Unexpected commands %q", f.commands)
+	}
+}
@@ -0,0 +1,336 @@
+package embed
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifestName is the last entry of a state archive, listing the SHA-256
+// of every other file in sha256sum format.
+const manifestName = "SHA256SUMS"
+
+// maxStateEntry and maxStateSize bound what ImportState unpacks from an
+// archive, per file and in total. The microdescriptor cache, the largest
+// file, is a few tens of MiB.
+var (
+	maxStateEntry int64 = 128 << 20
+	maxStateSize  int64 = 512 << 20
+)
+
+// microdescsJournal holds the microdescriptors Tor fetched since it last
+// rebuilt cached-microdescs. Unlike the other files it is appended to in
+// place, and truncated when the cache is rebuilt.
+const microdescsJournal = microdescsFile + ".new"
+
+// stateFiles are the data directory files ExportState always includes: the
+// state file holding the guards, and the directory caches.
+var stateFiles = []string{"state", certsFile, consensusFile, microdescsFile, microdescsJournal}
+
+// ExportOptions selects what ExportState includes besides the state file
+// and the directory caches.
+type ExportOptions struct {
+	// Keys includes the keys directory, the onion_keys directory of the
+	// default KeyStore and every onion service directory under the data
+	// directory. Anyone holding the archive can then
+	// impersonate these onion services.
+	Keys bool
+}
+
+// ExportState writes the persistent state of the Tor data directory
+// dataDir to w as a gzipped tar archive: the state file with the guards,
+// the directory caches and, with opts.Keys, the keys. A SHA-256 manifest
+// is appended so ImportState can check the archive.
+//
+// The export may run while Tor is using dataDir, as Tor replaces the state
+// file and the caches atomically. The cached-microdescs.new journal, which
+// Tor writes in place, is then left out; Tor fetches the microdescriptors
+// it held again.
+func ExportState(dataDir string, w io.Writer, opts *ExportOptions) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	err := checkDataDirLock(dataDir)
+	live := errors.Is(err, ErrDataDirInUse)
+	if err != nil && !live {
+		return err
+	}
+	names, err := stateFileNames(dataDir, opts.Keys, live)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	var manifest strings.Builder
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dataDir, filepath.FromSlash(name)))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Replaced or removed by Tor since it was listed
+			continue
+		} else if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		fmt.Fprintf(&manifest, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+
+	hdr := &tar.Header{Name: manifestName, Mode: 0600, Size: int64(manifest.Len()), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(tw, manifest.String()); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// stateFileNames lists the files to export as slash-separated paths
+// relative to dataDir. With live set, Tor is running on dataDir and the
+// microdescriptor journal is skipped.
+func stateFileNames(dataDir string, keys, live bool) ([]string, error) {
+	var names []string
+	for _, name := range stateFiles {
+		if live && name == microdescsJournal {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			names = append(names, name)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &DataDirError{Dir: dataDir, Err: err}
+		}
+	}
+	if !keys {
+		return names, nil
+	}
+
+	// The keys directories, and every directory holding onion service keys
+	root := os.DirFS(dataDir)
+	err := fs.WalkDir(root, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || name == "." {
+			return nil
+		}
+		if _, err := fs.Stat(root, path.Join(name, onionKeyFile)); name != "keys" && name != onionKeysDir && err != nil {
+			return nil
+		}
+		err = fs.WalkDir(root, name, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				names = append(names, name)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return fs.SkipDir
+	})
+	if err != nil {
+		return nil, &DataDirError{Dir: dataDir, Err: err}
+	}
+	return names, nil
+}
+
+// ImportState restores an archive written by ExportState into dataDir,
+// replacing the files it contains. The archive is unpacked into a staging
+// directory inside dataDir and checked against its manifest first, so a truncated
+// or corrupted archive leaves dataDir untouched and returns an error
+// wrapping ErrStateIntegrity. So does a file over 128 MiB or an archive
+// unpacking to over 512 MiB. If moving the files into place fails, the
+// files already replaced are restored. ImportState returns a *DataDirError
+// wrapping ErrDataDirInUse if a Tor is running on dataDir; import before
+// starting Tor.
+func ImportState(dataDir string, r io.Reader) error {
+	if err := prepareDataDir(dataDir); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(dataDir, ".import-")
+	if err != nil {
+		return &DataDirError{Dir: dataDir, Err: err}
+	}
+	defer os.RemoveAll(staging)
+
+	sums, manifest, err := unpackState(staging, r)
+	if err != nil {
+		return err
+	}
+	if err := checkManifest(sums, manifest); err != nil {
+		return err
+	}
+
+	// Tor may have been started while the archive was read
+	if err := checkDataDirLock(dataDir); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Files being replaced are moved aside until every file is in place,
+	// so a failure part way can put them back
+	old, err := os.MkdirTemp(dataDir, ".import-old-")
+	if err != nil {
+		return &DataDirError{Dir: dataDir, Err: err}
+	}
+	defer os.RemoveAll(old)
+	type move struct {
+		dst, saved string
+		placed     bool
+	}
+	var moves []move
+	undo := func() {
+		for j := len(moves) - 1; j >= 0; j-- {
+			if moves[j].placed {
+				os.Remove(moves[j].dst)
+			}
+			if moves[j].saved != "" {
+				os.Rename(moves[j].saved, moves[j].dst)
+			}
+		}
+	}
+	for _, name := range names {
+		m := move{dst: filepath.Join(dataDir, filepath.FromSlash(name))}
+		if err := os.MkdirAll(filepath.Dir(m.dst), 0700); err != nil {
+			undo()
+			return err
+		}
+		if _, err := os.Lstat(m.dst); err == nil {
+			m.saved = filepath.Join(old, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(m.saved), 0700); err != nil {
+				undo()
+				return err
+			}
+			if err := os.Rename(m.dst, m.saved); err != nil {
+				undo()
+				return err
+			}
+		} else if !os.IsNotExist(err) {
+			undo()
+			return err
+		}
+		moves = append(moves, m)
+		if err := os.Rename(filepath.Join(staging, filepath.FromSlash(name)), m.dst); err != nil {
+			undo()
+			return err
+		}
+		moves[len(moves)-1].placed = true
+	}
+	return nil
+}
+
+// unpackState extracts the regular files of a state archive into dir and
+// returns their SHA-256 sums along with the manifest.
+func unpackState(dir string, r io.Reader) (map[string]string, string, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrStateIntegrity, err)
+	}
+	tr := tar.NewReader(gz)
+	sums := map[string]string{}
+	var manifest strings.Builder
+	var hasManifest bool
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrStateIntegrity, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !fs.ValidPath(hdr.Name) || hdr.Name == "." {
+			return nil, "", fmt.Errorf("%w: unexpected entry %q", ErrStateIntegrity, hdr.Name)
+		}
+		if hdr.Name == manifestName {
+			hasManifest = true
+			if _, err := io.Copy(&manifest, io.LimitReader(tr, 1<<20)); err != nil {
+				return nil, "", fmt.Errorf("%w: %v", ErrStateIntegrity, err)
+			}
+			continue
+		}
+		if hdr.Name == lockFileName {
+			return nil, "", fmt.Errorf("%w: unexpected entry %q", ErrStateIntegrity, hdr.Name)
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return nil, "", err
+		}
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, "", fmt.Errorf("%w: duplicate entry %q", ErrStateIntegrity, hdr.Name)
+		} else if err != nil {
+			return nil, "", err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(tr, maxStateEntry+1))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrStateIntegrity, err)
+		}
+		if total += n; n > maxStateEntry || total > maxStateSize {
+			return nil, "", fmt.Errorf("%w: %s exceeds the size limit", ErrStateIntegrity, hdr.Name)
+		}
+		sums[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	if !hasManifest {
+		return nil, "", fmt.Errorf("%w: missing %s", ErrStateIntegrity, manifestName)
+	}
+	return sums, manifest.String(), nil
+}
+
+// checkManifest checks that manifest lists exactly the files in sums with
+// the same SHA-256.
+func checkManifest(sums map[string]string, manifest string) error {
+	listed := map[string]bool{}
+	for _, line := range strings.Split(manifest, "\n") {
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return fmt.Errorf("%w: malformed manifest line %q", ErrStateIntegrity, line)
+		}
+		got, found := sums[name]
+		if !found {
+			return fmt.Errorf("%w: %s is missing", ErrStateIntegrity, name)
+		}
+		if got != sum {
+			return fmt.Errorf("%w: %s has the wrong checksum", ErrStateIntegrity, name)
+		}
+		listed[name] = true
+	}
+	for name := range sums {
+		if !listed[name] {
+			return fmt.Errorf("%w: %s is not in the manifest", ErrStateIntegrity, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package embed
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportState(t *testing.T) {
+	src := t.TempDir()
+	files := map[string]string{
+		"state":                       "Guard in=default rsa_id=ABCD\n",
+		consensusFile:                 "network-status-version 3 microdesc\n",
+		microdescsJournal:             "onion-key\n",
+		"keys/ed25519_master_id":      "key",
+		"onion/hs_ed25519_secret_key": "secret",
+		"onion/hostname":              "example.onion\n",
+		"control_auth_cookie":         "cookie",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var plain, withKeys bytes.Buffer
+	if err := ExportState(src, &plain, nil); err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
+	if err := ExportState(src, &withKeys, &ExportOptions{Keys: true}); err != nil {
+		t.Fatalf("ExportState failed: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := ImportState(dst, bytes.NewReader(plain.Bytes())); err != nil {
+		t.Fatalf("ImportState failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "onion")); !os.IsNotExist(err) {
+		t.Error("Expected keys to be left out without ExportOptions.Keys")
+	}
+
+	dst = t.TempDir()
+	if err := ImportState(dst, bytes.NewReader(withKeys.Bytes())); err != nil {
+		t.Fatalf("ImportState failed: %v", err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if name == "control_auth_cookie" {
+			if err == nil {
+				t.Error("Expected the control cookie not to be exported")
+			}
+			continue
+		}
+		if err != nil || string(got) != content {
+			t.Errorf("%s = %q, %v, want %q", name, got, err, content)
+		}
+	}
+}
+
+func TestImportStateIntegrity(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "state"), bytes.Repeat([]byte("Guard\n"), 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := ExportState(src, &archive, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated := archive.Bytes()[:archive.Len()/2]
+	dst := t.TempDir()
+	if err := ImportState(dst, bytes.NewReader(truncated)); !errors.Is(err, ErrStateIntegrity) {
+		t.Errorf("Expected ErrStateIntegrity for a truncated archive, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "state")); !os.IsNotExist(err) {
+		t.Error("Expected a failed import to leave the data dir untouched")
+	}
+}
+
+func TestImportStateSizeLimit(t *testing.T) {
+	src := t.TempDir()
+	for _, name := range []string{"state", consensusFile} {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte("x"), 100), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if err := ExportState(src, &archive, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(entry, size int64) { maxStateEntry, maxStateSize = entry, size }(maxStateEntry, maxStateSize)
+	for _, limits := range [][2]int64{{99, 1000}, {100, 199}} {
+		maxStateEntry, maxStateSize = limits[0], limits[1]
+		dst := t.TempDir()
+		if err := ImportState(dst, bytes.NewReader(archive.Bytes())); !errors.Is(err, ErrStateIntegrity) {
+			t.Errorf("Limits %v: expected ErrStateIntegrity, got %v", limits, err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "state")); !os.IsNotExist(err) {
+			t.Errorf("Limits %v: expected the data dir to be left untouched", limits)
+		}
+	}
+	maxStateEntry, maxStateSize = 100, 200
+	if err := ImportState(t.TempDir(), bytes.NewReader(archive.Bytes())); err != nil {
+		t.Errorf("Expected the archive to fit the limits: %v", err)
+	}
+}
+
+func TestImportStateRollback(t *testing.T) {
+	src := t.TempDir()
+	for name, content := range map[string]string{consensusFile: "new", "keys/secret_id_key": "key"} {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if err := ExportState(src, &archive, &ExportOptions{Keys: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The consensus is replaced first, then keys can't be created as a
+	// file of that name is in the way
+	dst := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dst, consensusFile), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dst, "keys"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ImportState(dst, bytes.NewReader(archive.Bytes())); err == nil {
+		t.Fatal("Expected an error when a file can't be put in place")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, consensusFile)); string(data) != "old" {
+		t.Errorf("Replaced file was not restored, got %q", data)
+	}
+	entries, _ := os.ReadDir(dst)
+	for _, entry := range entries {
+		if entry.Name() != consensusFile && entry.Name() != "keys" {
+			t.Errorf("Unexpected %s left in the data dir", entry.Name())
+		}
+	}
+}
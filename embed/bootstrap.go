@@ -0,0 +1,272 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil"
+)
+
+// BootstrapProgress is a single step or warning reported while Tor
+// bootstraps. Steps come from STATUS_CLIENT BOOTSTRAP events; warnings that
+// commonly stall a bootstrap, such as clock skew or unreachable directory
+// servers, come from STATUS_GENERAL and STATUS_CLIENT events and carry the
+// progress of the last step seen.
+type BootstrapProgress struct {
+	// Action is the status event action, "BOOTSTRAP" for steps or for
+	// example "CLOCK_SKEW" or "DIR_ALL_UNREACHABLE" for warnings
+	Action string
+
+	// Severity is NOTICE for normal steps and WARN or ERR for problems
+	Severity string
+
+	// Progress is the bootstrap percentage, 0 to 100
+	Progress int
+
+	// Tag is the machine-readable phase name, e.g. "requesting_descriptors"
+	Tag string
+
+	// Summary is the human-readable phase description
+	Summary string
+
+	// Warning, Reason and Recommendation describe a problem when Severity
+	// is not NOTICE
+	Warning        string
+	Reason         string
+	Recommendation string
+
+	// Arguments holds every raw key/value argument of the event
+	Arguments map[string]string
+}
+
+// IsWarning returns true if the progress report describes a problem rather
+// than a normal bootstrap step.
+func (p BootstrapProgress) IsWarning() bool {
+	return p.Severity != "NOTICE"
+}
+
+// String formats the progress as Tor would log it.
+func (p BootstrapProgress) String() string {
+	s := fmt.Sprintf("%d%% (%s): %s", p.Progress, p.Tag, p.Summary)
+	if p.Warning != "" {
+		s += fmt.Sprintf(" [%s: %s]", p.Severity, p.Warning)
+	}
+	return s
+}
+
+// BootstrapFunc receives bootstrap progress. It is called synchronously
+// from the bootstrap loop and must not block or call back into Tor.
+type BootstrapFunc func(BootstrapProgress)
+
+// StartTorWithProgress starts Tor on the default instance and waits for it
+// to bootstrap, reporting each step to progress. See
+// Instance.StartTorWithProgress.
+func StartTorWithProgress(ctx context.Context, dataDir string, timeout time.Duration, progress BootstrapFunc) (*tor.Tor, error) {
+	return defaultInstance.StartTorWithProgress(ctx, dataDir, timeout, progress)
+}
+
+// StartTorWithProgress starts Tor for this instance and waits for it to
+// bootstrap, calling progress for every bootstrap step and warning. If the
+// timeout expires the returned error is a *BootstrapError naming the
+// phase Tor was stuck in. A nil progress func is allowed.
+func (i *Instance) StartTorWithProgress(ctx context.Context, dataDir string, timeout time.Duration, progress BootstrapFunc) (*tor.Tor, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t, err := i.startLocked(ctx, dataDir, nil, logOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create timeout context for bootstrap
+	bootCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := i.bootstrapLocked(bootCtx, t, progress); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// WaitBootstrap enables the network on t if it is disabled and blocks until
+// Tor reports 100% bootstrap, reporting each step to progress. It is the
+// progress-aware equivalent of t.EnableNetwork(ctx, true). On failure or
+// when ctx is done the error is a *BootstrapError.
+func WaitBootstrap(ctx context.Context, t *tor.Tor, progress BootstrapFunc) error {
+	if progress == nil {
+		progress = func(BootstrapProgress) {}
+	}
+
+	// Subscribe before enabling the network so no step is missed. The buffer
+	// keeps Tor's event relay from blocking while we issue requests below.
+	codes := []control.EventCode{control.EventCodeStatusClient, control.EventCodeStatusGeneral}
+	eventCh := make(chan control.Event, 64)
+	if err := t.Control.AddEventListener(eventCh, codes...); err != nil {
+		return &BootstrapError{Phase: "starting", Err: err}
+	}
+	defer func() {
+		// Events are relayed with a blocking send while the reader holds
+		// the connection, so keep draining until the SETEVENTS reply of
+		// the removal has been read; see watch
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-eventCh:
+				case <-done:
+					return
+				}
+			}
+		}()
+		t.Control.RemoveEventListener(eventCh, codes...)
+		close(done)
+	}()
+
+	eventCtx, eventCancel := context.WithCancel(ctx)
+	defer eventCancel()
+	errCh := make(chan error, 1)
+	go func() { errCh <- t.Control.HandleEvents(eventCtx) }()
+
+	// Report where bootstrap currently stands
+	last := BootstrapProgress{Action: "BOOTSTRAP", Severity: "NOTICE", Tag: "starting"}
+	if info, err := t.Control.GetInfo("status/bootstrap-phase"); err == nil && len(info) == 1 {
+		status := control.ParseStatusEvent(control.EventCodeStatusClient, info[0].Val)
+		if p, ok := bootstrapProgressFromStatus(status, last); ok {
+			last = p
+			progress(p)
+			if p.Progress == 100 {
+				return nil
+			}
+		}
+	}
+
+	if err := enableNetwork(t.Control); err != nil {
+		return &BootstrapError{Phase: last.Tag, Summary: last.Summary, Progress: last.Progress, Err: err}
+	}
+
+	var lastWarning string
+	for {
+		select {
+		case <-eventCtx.Done():
+			return &BootstrapError{Phase: last.Tag, Summary: last.Summary, Progress: last.Progress,
+				Warning: lastWarning, Err: eventCtx.Err()}
+		case err := <-errCh:
+			return &BootstrapError{Phase: last.Tag, Summary: last.Summary, Progress: last.Progress,
+				Warning: lastWarning, Err: err}
+		case evt := <-eventCh:
+			status, _ := evt.(*control.StatusEvent)
+			if status == nil {
+				continue
+			}
+			p, ok := bootstrapProgressFromStatus(status, last)
+			if !ok {
+				continue
+			}
+			progress(p)
+			if p.IsWarning() {
+				lastWarning = p.Warning
+			}
+			if p.Action == "BOOTSTRAP" && p.Severity == "NOTICE" {
+				last = p
+				if p.Progress == 100 {
+					return nil
+				}
+			}
+			if p.Severity == "ERR" {
+				return &BootstrapError{Phase: last.Tag, Summary: last.Summary, Progress: last.Progress,
+					Warning: p.Warning, Err: ErrBootstrapFatal}
+			}
+		}
+	}
+}
+
+// enableNetwork clears DisableNetwork if it is set. Unlike
+// tor.Tor.EnableNetwork it reports a failed SETCONF.
+func enableNetwork(conn *control.Conn) error {
+	vals, err := conn.GetConf("DisableNetwork")
+	if err != nil {
+		return err
+	}
+	if len(vals) == 0 || vals[0].Key != "DisableNetwork" || vals[0].Val != "1" {
+		return nil
+	}
+	return conn.SetConf(control.KeyVals("DisableNetwork", "0")...)
+}
+
+// bootstrapProgressFromStatus converts a status event into a progress
+// report. Bootstrap steps are returned as-is; warnings relevant to
+// bootstrapping inherit the phase of last. Other events are ignored.
+func bootstrapProgressFromStatus(status *control.StatusEvent, last BootstrapProgress) (BootstrapProgress, bool) {
+	// control.ParseStatusEvent splits quoted values on spaces, so the
+	// arguments are parsed again from the raw event
+	args := parseStatusArguments(status.Raw)
+	p := BootstrapProgress{
+		Action:         status.Action,
+		Severity:       status.Severity,
+		Progress:       last.Progress,
+		Tag:            last.Tag,
+		Summary:        last.Summary,
+		Warning:        args["WARNING"],
+		Reason:         args["REASON"],
+		Recommendation: args["RECOMMENDATION"],
+		Arguments:      args,
+	}
+
+	switch status.Action {
+	case "BOOTSTRAP":
+		if n, err := strconv.Atoi(args["PROGRESS"]); err == nil {
+			p.Progress = n
+		}
+		p.Tag = args["TAG"]
+		p.Summary = args["SUMMARY"]
+	case "CLOCK_SKEW":
+		p.Warning = fmt.Sprintf("clock skew of %s seconds reported by %s", args["SKEW"], args["SOURCE"])
+	case "DIR_ALL_UNREACHABLE":
+		p.Warning = "all directory servers are unreachable"
+	default:
+		return BootstrapProgress{}, false
+	}
+	return p, true
+}
+
+// parseStatusArguments parses the KEY=VALUE arguments of a raw status event
+// such as `NOTICE BOOTSTRAP PROGRESS=5 SUMMARY="Connecting to a relay"`,
+// skipping the leading severity and action.
+func parseStatusArguments(raw string) map[string]string {
+	args := map[string]string{}
+	fields := 0
+	for raw = strings.TrimSpace(raw); raw != ""; raw = strings.TrimSpace(raw) {
+		// Read one space-separated field, keeping quoted sections intact
+		end := len(raw)
+		quoted := false
+		for j := 0; j < len(raw); j++ {
+			if quoted && raw[j] == '\\' {
+				j++
+			} else if raw[j] == '"' {
+				quoted = !quoted
+			} else if raw[j] == ' ' && !quoted {
+				end = j
+				break
+			}
+		}
+		field := raw[:end]
+		raw = raw[end:]
+
+		fields++
+		if fields <= 2 {
+			continue
+		}
+		key, val, _ := torutil.PartitionString(field, '=')
+		if unquoted, err := torutil.UnescapeSimpleQuotedStringIfNeeded(val); err == nil {
+			val = unquoted
+		}
+		args[key] = val
+	}
+	return args
+}
@@ -0,0 +1,144 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+func TestBootstrapProgressFromStatus(t *testing.T) {
+	last := BootstrapProgress{Action: "BOOTSTRAP", Severity: "NOTICE", Tag: "starting"}
+
+	status := control.ParseStatusEvent(control.EventCodeStatusClient,
+		`NOTICE BOOTSTRAP PROGRESS=45 TAG=requesting_descriptors SUMMARY="Asking for relay descriptors"`)
+	p, ok := bootstrapProgressFromStatus(status, last)
+	if !ok {
+		t.Fatal("Expected BOOTSTRAP event to be reported")
+	}
+	if p.Progress != 45 || p.Tag != "requesting_descriptors" || p.Summary != "Asking for relay descriptors" {
+		t.Errorf("Unexpected progress: %+v", p)
+	}
+	if p.IsWarning() {
+		t.Error("NOTICE step should not be a warning")
+	}
+
+	// Warnings keep the phase of the last step
+	skew := control.ParseStatusEvent(control.EventCodeStatusGeneral,
+		`WARN CLOCK_SKEW SKEW=-3600 SOURCE=CONSENSUS`)
+	w, ok := bootstrapProgressFromStatus(skew, p)
+	if !ok {
+		t.Fatal("Expected CLOCK_SKEW to be reported")
+	}
+	if !w.IsWarning() || w.Tag != "requesting_descriptors" || w.Progress != 45 {
+		t.Errorf("Unexpected warning: %+v", w)
+	}
+	if !strings.Contains(w.Warning, "-3600") {
+		t.Errorf("Expected skew in warning, got %q", w.Warning)
+	}
+
+	dirWarn := control.ParseStatusEvent(control.EventCodeStatusClient,
+		`WARN BOOTSTRAP PROGRESS=10 TAG=conn_done SUMMARY="Connected to a relay" WARNING="Connection refused" REASON=CONNECTREFUSED RECOMMENDATION=warn`)
+	d, _ := bootstrapProgressFromStatus(dirWarn, p)
+	if d.Warning != "Connection refused" || d.Reason != "CONNECTREFUSED" || d.Recommendation != "warn" {
+		t.Errorf("Unexpected dir warning: %+v", d)
+	}
+
+	// Unrelated status events are ignored
+	other := control.ParseStatusEvent(control.EventCodeStatusClient, `NOTICE CIRCUIT_ESTABLISHED`)
+	if _, ok := bootstrapProgressFromStatus(other, last); ok {
+		t.Error("Expected CIRCUIT_ESTABLISHED to be ignored")
+	}
+}
+
+func TestBootstrapErrorNamesPhase(t *testing.T) {
+	err := error(&BootstrapError{
+		Phase:    "loading_descriptors",
+		Summary:  "Loading relay descriptors",
+		Progress: 60,
+		Err:      context.DeadlineExceeded,
+	})
+
+	if !strings.Contains(err.Error(), "60%") || !strings.Contains(err.Error(), "loading_descriptors") {
+		t.Errorf("Error does not name the stuck phase: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expected BootstrapError to unwrap to its cause")
+	}
+
+	var bootErr *BootstrapError
+	if !errors.As(err, &bootErr) || bootErr.Phase != "loading_descriptors" {
+		t.Error("Expected errors.As to find the BootstrapError")
+	}
+}
+
+func TestWaitBootstrapRemovesListener(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		conn := textproto.NewConn(server)
+		defer conn.Close()
+		// Write from another goroutine so commands are read while events
+		// are pending, as a socket buffer allows
+		out := make(chan string, 1024)
+		go func() {
+			for r := range out {
+				if conn.PrintfLine("%s", r) != nil {
+					return
+				}
+			}
+		}()
+		defer close(out)
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			var reply []string
+			switch {
+			case strings.HasPrefix(line, "SETEVENTS"):
+				reply = []string{"250 OK"}
+			case line == "GETINFO status/bootstrap-phase":
+				reply = []string{`250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=0 TAG=starting SUMMARY="Starting"`, "250 OK"}
+			case line == "GETCONF DisableNetwork":
+				reply = []string{"250 DisableNetwork=1"}
+			case strings.HasPrefix(line, "SETCONF"):
+				reply = []string{"250 OK", `650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`}
+				// More status events than the listener buffers follow
+				// before it is removed
+				for j := 0; j < 100; j++ {
+					reply = append(reply, "650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED")
+				}
+			default:
+				reply = []string{"510 Unrecognized command"}
+			}
+			for _, r := range reply {
+				out <- r
+			}
+		}
+	}()
+
+	tr := &tor.Tor{Control: control.NewConn(textproto.NewConn(client))}
+	done := make(chan error, 1)
+	slow := func(p BootstrapProgress) {
+		if p.Progress == 100 {
+			// Let the event reader fill the buffer
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	go func() { done <- WaitBootstrap(context.Background(), tr, slow) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitBootstrap blocked removing its event listener")
+	}
+}
@@ -0,0 +1,118 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
+	"github.com/cretz/bine/process"
+)
+
+// childEnv marks a process started by the child creator as a Tor child
+const childEnv = "TOR_STATIC_BUILDER_CHILD"
+
+// childExitDelay is how long a child asked to exit may take before it is
+// killed
+const childExitDelay = 10 * time.Second
+
+// RunAsTorIfRequested runs the embedded Tor and exits if this process was
+// started as a Tor child by NewChildCreator. Otherwise it returns
+// immediately. Call it first thing in main, before flag parsing:
+//
+//	func main() {
+//		embed.RunAsTorIfRequested()
+//		// ...
+//	}
+func RunAsTorIfRequested() {
+	if os.Getenv(childEnv) != "1" {
+		return
+	}
+	os.Exit(tor048.RunMain(os.Args[1:]))
+}
+
+// IsTorChild returns true if this process was started as a Tor child by
+// NewChildCreator.
+func IsTorChild() bool {
+	return os.Getenv(childEnv) == "1"
+}
+
+// NewChildCreator returns a process.Creator that runs the embedded Tor in a
+// child process by re-executing the current binary, which must call
+// RunAsTorIfRequested at the top of main. The child is connected to over
+// its control port and exits if this process dies.
+//
+// Compared to the in-process Tor, a child gives crash isolation (a Tor
+// assertion does not take the application down), can be restarted any
+// number of times and can be killed outright with Instance.Kill. Use it
+// with NewInstanceWithCreator, or NewChildInstance for short.
+func NewChildCreator() process.Creator {
+	return childCreator{}
+}
+
+// NewChildInstance creates an Instance that runs Tor in a child process.
+// See NewChildCreator.
+func NewChildInstance() *Instance {
+	return NewInstanceWithCreator(NewChildCreator())
+}
+
+type childCreator struct{}
+
+// New implements process.Creator.New
+func (childCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate own executable: %w", err)
+	}
+
+	// Tor exits on its own if the owning process goes away
+	args = append(args, "--__OwningControllerProcess", strconv.Itoa(os.Getpid()))
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Env = append(os.Environ(), childEnv+"=1")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Cancelling ctx asks Tor to exit cleanly and kills it only if it is
+	// still running after childExitDelay; Kill is what kills it outright
+	cmd.Cancel = func() error {
+		return interruptProcess(cmd.Process)
+	}
+	cmd.WaitDelay = childExitDelay
+	return &childProcess{cmd: cmd}, nil
+}
+
+// childProcess is a Tor child started from the current executable.
+type childProcess struct {
+	cmd *exec.Cmd
+}
+
+// Start implements process.Process.Start
+func (c *childProcess) Start() error {
+	return c.cmd.Start()
+}
+
+// Wait implements process.Process.Wait, reporting a non-zero exit as an
+// *ExitError like the in-process Tor does.
+func (c *childProcess) Wait() error {
+	err := c.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
+
+// Kill kills the child outright, without giving Tor a chance to clean up.
+func (c *childProcess) Kill() error {
+	return c.cmd.Process.Kill()
+}
+
+// EmbeddedControlConn implements process.Process.EmbeddedControlConn
+func (c *childProcess) EmbeddedControlConn() (net.Conn, error) {
+	return nil, process.ErrControlConnUnsupported
+}
@@ -0,0 +1,60 @@
+package embed
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/cretz/bine/process"
+)
+
+func TestRunAsTorIfRequestedReturnsByDefault(t *testing.T) {
+	if IsTorChild() {
+		t.Skip("Test binary is running as a Tor child")
+	}
+	// Must return without running Tor or exiting
+	RunAsTorIfRequested()
+}
+
+func TestChildCreatorReexecutesSelf(t *testing.T) {
+	p, err := NewChildCreator().New(context.Background(), "--SocksPort", "auto")
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	cmd := p.(*childProcess).cmd
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Path != exe {
+		t.Errorf("Got path %s, want %s", cmd.Path, exe)
+	}
+
+	args := cmd.Args[1:]
+	want := []string{"--SocksPort", "auto", "--__OwningControllerProcess", strconv.Itoa(os.Getpid())}
+	if len(args) != len(want) {
+		t.Fatalf("Got args %q, want %q", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("Got args %q, want %q", args, want)
+			break
+		}
+	}
+
+	found := false
+	for _, env := range cmd.Env {
+		if env == childEnv+"=1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Child environment does not request Tor mode")
+	}
+
+	if _, err := p.EmbeddedControlConn(); err != process.ErrControlConnUnsupported {
+		t.Errorf("Expected ErrControlConnUnsupported, got %v", err)
+	}
+}
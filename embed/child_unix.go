@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package embed
+
+import (
+	"os"
+	"syscall"
+)
+
+// interruptProcess asks a Tor child to exit; Tor cleans up on SIGTERM.
+func interruptProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
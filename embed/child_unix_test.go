@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package embed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// shellChild returns a child process running script in place of Tor
+func shellChild(t *testing.T, ctx context.Context, script string) *childProcess {
+	p, err := NewChildCreator().New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell to stand in for Tor")
+	}
+	child := p.(*childProcess)
+	child.cmd.Path = sh
+	child.cmd.Args = []string{"sh", "-c", script}
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return child
+}
+
+func TestChildCancelInterrupts(t *testing.T) {
+	ready := filepath.Join(t.TempDir(), "ready")
+	script := `trap "exit 3" TERM; touch ` + ready + `; while :; do sleep 0.05; done`
+	ctx, cancel := context.WithCancel(context.Background())
+	child := shellChild(t, ctx, script)
+	for {
+		if _, err := os.Stat(ready); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	var exitErr *ExitError
+	if err := child.Wait(); !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Errorf("Expected the child to exit cleanly on cancel, got %v", err)
+	}
+
+	child = shellChild(t, context.Background(), script)
+	if err := child.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Wait(); !errors.As(err, &exitErr) || exitErr.Code != -1 {
+		t.Errorf("Expected the child to be killed, got %v", err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package embed
+
+import "os"
+
+// interruptProcess asks a Tor child to exit. Windows has no signal for
+// that, so the child is terminated.
+func interruptProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,383 @@
+package embed
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RelayAnon/tor-static-builder/embed/onion"
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
+)
+
+// clientAuthPrefix starts the v3 client authorization key lines of Tor's
+// .auth and .auth_private files.
+const clientAuthPrefix = "descriptor:x25519:"
+
+// keyEncoding is how Tor writes x25519 keys: unpadded base32.
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// ClientPublicKey is the x25519 public key of a client authorized to
+// connect to a v3 onion service.
+type ClientPublicKey [32]byte
+
+// String returns the key in base32 as Tor writes it, the value of
+// ADD_ONION ClientAuthV3.
+func (k ClientPublicKey) String() string {
+	return keyEncoding.EncodeToString(k[:])
+}
+
+// AuthLine returns the line of an authorized_clients/<name>.auth file in
+// a HiddenServiceDir authorizing the client.
+func (k ClientPublicKey) AuthLine() string {
+	return clientAuthPrefix + k.String()
+}
+
+// ParseClientPublicKey parses a client public key in base32, or a line of
+// an .auth file starting with "descriptor:x25519:".
+func ParseClientPublicKey(s string) (ClientPublicKey, error) {
+	var key ClientPublicKey
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, clientAuthPrefix)
+	raw, err := keyEncoding.DecodeString(strings.ToUpper(s))
+	if err != nil || len(raw) != len(key) {
+		return key, fmt.Errorf("invalid x25519 client public key %q", s)
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// ClientKey is the x25519 key pair of a client of a v3 onion service. The
+// service is given Public; the client keeps Private, in the .auth_private
+// file written by WriteAuthPrivate.
+type ClientKey struct {
+	Public  ClientPublicKey
+	Private [32]byte
+}
+
+// GenerateClientKey generates a new client key pair.
+func GenerateClientKey() (*ClientKey, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	key := &ClientKey{}
+	copy(key.Private[:], priv.Bytes())
+	copy(key.Public[:], priv.PublicKey().Bytes())
+	return key, nil
+}
+
+// AuthPrivate returns the contents of the .auth_private file that lets a
+// client whose Tor has ClientOnionAuthDir set connect to the service at
+// address, with or without ".onion".
+func (k *ClientKey) AuthPrivate(address string) (string, error) {
+	id := strings.TrimSuffix(strings.ToLower(address), ".onion")
+	if err := onion.ValidateID(id); err != nil {
+		return "", err
+	}
+	return id + ":" + clientAuthPrefix + keyEncoding.EncodeToString(k.Private[:]) + "\n", nil
+}
+
+// WriteAuthPrivate writes the .auth_private file of the client key for the
+// service at address to dir/<name>.auth_private, readable by the owner
+// only. dir is the client's ClientOnionAuthDir, such as a directory to
+// hand to a user.
+func WriteAuthPrivate(dir, name, address string, key *ClientKey) error {
+	data, err := key.AuthPrivate(address)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(dir, name+".auth_private", []byte(data))
+}
+
+// WriteAuthorizedClient authorizes the client with public key pub for the
+// onion service in the HiddenServiceDir dir, such as one of
+// Config.OnionServices, by writing authorized_clients/<name>.auth. Tor
+// reads the directory when it loads the service.
+func WriteAuthorizedClient(dir, name string, pub ClientPublicKey) error {
+	return writeKeyFile(filepath.Join(dir, "authorized_clients"), name+".auth", []byte(pub.AuthLine()+"\n"))
+}
+
+// ListenAuthorized creates an onion service on the default instance that
+// only the given clients can connect to.
+func ListenAuthorized(ctx context.Context, conf *tor.ListenConf, clients map[string]ClientPublicKey) (*OnionListener, error) {
+	return defaultInstance.ListenAuthorized(ctx, conf, clients)
+}
+
+// ListenAuthorized is Listen for a v3 onion service with client
+// authorization: only the clients holding the private halves of the keys
+// in clients, which are keyed by a name for each client, can connect.
+// Clients are added and revoked later with AuthorizeClient and
+// RevokeClient. The service key is kept to create the service again for
+// them, so conf.DiscardKey must be false; conf.Key, if set, must be an
+// ed25519 key.
+func (i *Instance) ListenAuthorized(ctx context.Context, conf *tor.ListenConf, clients map[string]ClientPublicKey) (*OnionListener, error) {
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	if conf == nil {
+		conf = &tor.ListenConf{}
+	}
+	if len(clients) == 0 {
+		return nil, errors.New("no clients to authorize")
+	}
+	record := &OnionService{KeySource: KeyGenerated}
+	if conf.Key != nil {
+		record.KeySource = KeyProvided
+	}
+	authorized := make(map[string]ClientPublicKey, len(clients))
+	for name, key := range clients {
+		authorized[name] = key
+	}
+	return i.listen(ctx, t, conf, record, authorized)
+}
+
+// Clients returns the authorized clients of the service, or nil if anyone
+// with the address can connect.
+func (l *OnionListener) Clients() map[string]ClientPublicKey {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		return nil
+	}
+	clients := make(map[string]ClientPublicKey, len(l.clients))
+	for name, key := range l.clients {
+		clients[name] = key
+	}
+	return clients
+}
+
+// AuthorizeClient authorizes a client to connect, replacing the key of a
+// client of the same name. Authorizing the first client of a service
+// created without any restricts it to its authorized clients from then on.
+//
+// Tor can't change the clients of a running service, so the service is
+// removed and created again with the same key and address. It is briefly
+// unreachable and its descriptor is published again; connections already
+// accepted are not affected. If creating it again fails, the previous
+// clients are restored.
+func (l *OnionListener) AuthorizeClient(name string, key ClientPublicKey) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clients := map[string]ClientPublicKey{name: key}
+	for other, key := range l.clients {
+		if other != name {
+			clients[other] = key
+		}
+	}
+	return l.setClientsLocked(clients)
+}
+
+// RevokeClient revokes the authorization of the named client, as
+// AuthorizeClient does. Revoking the last client is an error: close the
+// service instead, or create a new one without client authorization.
+func (l *OnionListener) RevokeClient(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.clients[name]; !ok {
+		return fmt.Errorf("client %q is not authorized", name)
+	}
+	if len(l.clients) == 1 {
+		return errors.New("cannot revoke the last authorized client")
+	}
+	clients := map[string]ClientPublicKey{}
+	for other, key := range l.clients {
+		if other != name {
+			clients[other] = key
+		}
+	}
+	return l.setClientsLocked(clients)
+}
+
+// setClientsLocked creates the service again with clients.
+func (l *OnionListener) setClientsLocked(clients map[string]ClientPublicKey) error {
+	if l.ID == "" {
+		return net.ErrClosed
+	}
+	if l.Key == nil {
+		return errors.New("the key of the service was discarded")
+	}
+	key, err := v3Key(l.Key)
+	if err != nil {
+		return err
+	}
+	t := l.Tor
+	if err := t.Control.DelOnion(l.ID); err != nil {
+		return fmt.Errorf("failed to remove onion service: %w", err)
+	}
+	if _, err := addOnionV3(t.Control, key, l.OnionService, &l.conf, clients); err != nil {
+		if _, restoreErr := addOnionV3(t.Control, key, l.OnionService, &l.conf, l.clients); restoreErr != nil {
+			// The service is gone from Tor, Close only closes the local
+			// listener
+			l.inst.onions.remove(l.ID)
+			l.ID = ""
+		}
+		return fmt.Errorf("failed to create onion service: %w", err)
+	}
+	l.clients = clients
+	l.inst.onions.setClients(l.ID, clientNames(clients))
+	return nil
+}
+
+// listenAuthorized is t.Listen for a v3 service with client
+// authorization, which bine does not support.
+func listenAuthorized(ctx context.Context, t *tor.Tor, conf *tor.ListenConf, clients map[string]ClientPublicKey) (*tor.OnionService, error) {
+	if conf.DiscardKey {
+		return nil, errors.New("client authorization needs the service key, conf.DiscardKey must be false")
+	}
+	key, err := v3Key(conf.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := &tor.OnionService{Key: key, Version3: true, Tor: t, LocalListener: conf.LocalListener}
+	if svc.LocalListener == nil {
+		if svc.LocalListener, err = net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(conf.LocalPort)); err != nil {
+			return nil, err
+		}
+		svc.CloseLocalListenerOnClose = true
+	}
+	svc.RemotePorts = append([]int(nil), conf.RemotePorts...)
+	if len(svc.RemotePorts) == 0 {
+		addr, ok := svc.LocalListener.Addr().(*net.TCPAddr)
+		if !ok {
+			svc.Close()
+			return nil, errors.New("unable to derive local TCP port")
+		}
+		svc.RemotePorts = []int{addr.Port}
+	}
+
+	if svc.ID, err = addOnionV3(t.Control, key, svc, conf, clients); err != nil {
+		svc.Close()
+		return nil, err
+	}
+	if !conf.NoWait {
+		if err := waitPublished(ctx, t, svc.ID); err != nil {
+			svc.Close()
+			return nil, err
+		}
+	}
+	return svc, nil
+}
+
+// v3Key returns key as a bine ed25519 key, generating one if it is nil.
+func v3Key(key crypto.PrivateKey) (tored25519.KeyPair, error) {
+	switch key := key.(type) {
+	case nil:
+		return tored25519.GenerateKey(nil)
+	case tored25519.KeyPair:
+		return key, nil
+	case ed25519.PrivateKey:
+		return ExpandKey(key), nil
+	case *control.ED25519Key:
+		return key.KeyPair, nil
+	default:
+		return nil, fmt.Errorf("client authorization needs a v3 service, unsupported key type %T", key)
+	}
+}
+
+// addOnionV3 sends ADD_ONION for the v3 service svc and returns its ID.
+func addOnionV3(conn *control.Conn, key tored25519.KeyPair, svc *tor.OnionService, conf *tor.ListenConf,
+	clients map[string]ClientPublicKey) (string, error) {
+	resp, err := conn.SendRequest("%s", addOnionCommand(key, svc, conf, clients))
+	if err != nil {
+		return "", err
+	}
+	for _, data := range resp.Data {
+		if id, ok := strings.CutPrefix(data, "ServiceID="); ok {
+			return id, nil
+		}
+	}
+	return "", errors.New("tor did not return the service ID")
+}
+
+// addOnionCommand returns the ADD_ONION command creating the v3 service
+// svc with key, the flags and limits of conf and the given clients.
+func addOnionCommand(key tored25519.KeyPair, svc *tor.OnionService, conf *tor.ListenConf,
+	clients map[string]ClientPublicKey) string {
+	var flags []string
+	if conf.Detach {
+		flags = append(flags, "Detach")
+	}
+	if conf.NonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	if conf.MaxStreamsCloseCircuit {
+		flags = append(flags, "MaxStreamsCloseCircuit")
+	}
+	if len(clients) > 0 {
+		flags = append(flags, "V3Auth")
+	}
+
+	cmd := "ADD_ONION " + ED25519V3Blob(key)
+	if len(flags) > 0 {
+		cmd += " Flags=" + strings.Join(flags, ",")
+	}
+	if conf.MaxStreams > 0 {
+		cmd += " MaxStreams=" + strconv.Itoa(conf.MaxStreams)
+	}
+	for _, port := range listenerPorts(svc) {
+		cmd += " Port=" + strconv.Itoa(port.Virtual) + "," + port.Target
+	}
+	for _, name := range clientNames(clients) {
+		cmd += " ClientAuthV3=" + clients[name].String()
+	}
+	return cmd
+}
+
+// waitPublished enables the network if needed and waits until the
+// descriptor of the service with the given ID is uploaded to an HSDir, or
+// every upload failed.
+func waitPublished(ctx context.Context, t *tor.Tor, id string) error {
+	if err := t.EnableNetwork(ctx, true); err != nil {
+		return err
+	}
+	uploads := 0
+	var failures []string
+	_, err := t.Control.EventWait(ctx, []control.EventCode{control.EventCodeHSDesc},
+		func(evt control.Event) (bool, error) {
+			hs, _ := evt.(*control.HSDescEvent)
+			if hs == nil || hs.Address != id {
+				return false, nil
+			}
+			switch hs.Action {
+			case "UPLOAD":
+				uploads++
+			case "FAILED":
+				failures = append(failures, fmt.Sprintf("%s: %s", hs.HSDir, hs.Reason))
+				if len(failures) == uploads {
+					return false, fmt.Errorf("failed to publish onion service: %s", strings.Join(failures, ", "))
+				}
+			case "UPLOADED":
+				return true, nil
+			}
+			return false, nil
+		})
+	return err
+}
+
+// clientNames returns the sorted names of clients, or nil if there are
+// none.
+func clientNames(clients map[string]ClientPublicKey) []string {
+	if len(clients) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,135 @@
+package embed
+
+import (
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/tor"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestGenerateClientKey(t *testing.T) {
+	key, err := GenerateClientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ecdh.X25519().NewPrivateKey(key.Private[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(priv.PublicKey().Bytes()) != string(key.Public[:]) {
+		t.Error("Public key does not match the private key")
+	}
+
+	s := key.Public.String()
+	if len(s) != 52 || strings.ToUpper(s) != s {
+		t.Errorf("Unexpected public key %q", s)
+	}
+	for _, in := range []string{s, strings.ToLower(s), key.Public.AuthLine() + "\n"} {
+		parsed, err := ParseClientPublicKey(in)
+		if err != nil {
+			t.Fatalf("ParseClientPublicKey(%q): %v", in, err)
+		}
+		if parsed != key.Public {
+			t.Errorf("ParseClientPublicKey(%q) differs", in)
+		}
+	}
+	for _, in := range []string{"", s[:50], "descriptor:x25519:!" + s[1:]} {
+		if _, err := ParseClientPublicKey(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
+
+func TestAuthPrivate(t *testing.T) {
+	key, _ := GenerateClientKey()
+	data, err := key.AuthPrivate(testOnionID + ".onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testOnionID + ":descriptor:x25519:" + keyEncoding.EncodeToString(key.Private[:]) + "\n"
+	if data != want {
+		t.Errorf("AuthPrivate = %q, want %q", data, want)
+	}
+	if _, err := key.AuthPrivate("example.onion"); err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+
+	dir := t.TempDir()
+	if err := WriteAuthPrivate(dir, "alice", testOnionID, key); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "alice.auth_private")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("File mode %o is accessible by others", info.Mode().Perm())
+	}
+	if written, _ := os.ReadFile(path); string(written) != want {
+		t.Errorf("Written %q, want %q", written, want)
+	}
+
+	if err := WriteAuthorizedClient(dir, "alice", key.Public); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := os.ReadFile(filepath.Join(dir, "authorized_clients", "alice.auth"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := ParseClientPublicKey(string(auth)); err != nil || parsed != key.Public {
+		t.Errorf("Unexpected .auth file %q", auth)
+	}
+}
+
+func TestAddOnionCommand(t *testing.T) {
+	key, _ := tored25519.GenerateKey(nil)
+	alice, _ := GenerateClientKey()
+	bob, _ := GenerateClientKey()
+	svc := &tor.OnionService{RemotePorts: []int{80}}
+	conf := &tor.ListenConf{Detach: true, MaxStreams: 5}
+
+	cmd := addOnionCommand(key, svc, conf, map[string]ClientPublicKey{"bob": bob.Public, "alice": alice.Public})
+	want := "ADD_ONION " + ED25519V3Blob(key) + " Flags=Detach,V3Auth MaxStreams=5 Port=80," +
+		" ClientAuthV3=" + alice.Public.String() + " ClientAuthV3=" + bob.Public.String()
+	if cmd != want {
+		t.Errorf("Got %q\nwant %q", cmd, want)
+	}
+
+	cmd = addOnionCommand(key, svc, &tor.ListenConf{}, nil)
+	if strings.Contains(cmd, "Flags=") || strings.Contains(cmd, "ClientAuthV3") {
+		t.Errorf("Unexpected command without clients %q", cmd)
+	}
+}
+
+func TestListenAuthorizedNotRunning(t *testing.T) {
+	key, _ := GenerateClientKey()
+	_, err := NewInstance().ListenAuthorized(context.Background(), nil, map[string]ClientPublicKey{"alice": key.Public})
+	if !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Got %v, want ErrNotRunning", err)
+	}
+}
+
+func TestRegistrySetClients(t *testing.T) {
+	inst := NewInstance()
+	inst.onions.add(&OnionService{ID: testOnionID, KeySource: KeyGenerated, Status: Published,
+		Clients: []string{"alice"}})
+	changes, cancel := inst.SubscribeOnionServices()
+	defer cancel()
+
+	inst.onions.setClients(testOnionID, []string{"alice", "bob"})
+	c := <-changes
+	if c.Kind != OnionClientsChanged || len(c.Service.Clients) != 2 || c.Service.Status != PublishPending {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+	svc, _ := inst.LookupOnionService(testOnionID)
+	if len(svc.Clients) != 2 || svc.Clients[1] != "bob" {
+		t.Errorf("Unexpected clients %v", svc.Clients)
+	}
+}
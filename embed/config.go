@@ -0,0 +1,769 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cretz/bine/torutil"
+)
+
+// Option is a single Tor configuration option, such as the line
+// "SocksPort 9050" of a torrc.
+type Option struct {
+	Key   string
+	Value string
+}
+
+// PortFlag is a flag of a client listener such as a SocksPort. Flags that
+// are not declared below can be given as PortFlag("Name").
+type PortFlag string
+
+// Commonly used port flags. Every isolation flag can be negated with a
+// "No" prefix, e.g. NoIsolateSOCKSAuth.
+const (
+	IsolateClientAddr         PortFlag = "IsolateClientAddr"
+	IsolateSOCKSAuth          PortFlag = "IsolateSOCKSAuth"
+	IsolateClientProtocol     PortFlag = "IsolateClientProtocol"
+	IsolateDestPort           PortFlag = "IsolateDestPort"
+	IsolateDestAddr           PortFlag = "IsolateDestAddr"
+	KeepAliveIsolateSOCKSAuth PortFlag = "KeepAliveIsolateSOCKSAuth"
+	NoIsolateClientAddr       PortFlag = "NoIsolateClientAddr"
+	NoIsolateSOCKSAuth        PortFlag = "NoIsolateSOCKSAuth"
+	OnionTrafficOnly          PortFlag = "OnionTrafficOnly"
+	NoOnionTraffic            PortFlag = "NoOnionTraffic"
+	NoDNSRequest              PortFlag = "NoDNSRequest"
+	NoIPv4Traffic             PortFlag = "NoIPv4Traffic"
+	IPv6Traffic               PortFlag = "IPv6Traffic"
+	PreferIPv6                PortFlag = "PreferIPv6"
+	ExtendedErrors            PortFlag = "ExtendedErrors"
+
+	// GroupWritable, WorldWritable and RelaxDirModeCheck only apply to
+	// unix socket listeners
+	GroupWritable     PortFlag = "GroupWritable"
+	WorldWritable     PortFlag = "WorldWritable"
+	RelaxDirModeCheck PortFlag = "RelaxDirModeCheck"
+)
+
+// portFlags are the flags Tor accepts on client listeners, without their
+// optional "No" prefix. The value is true for unix-socket-only flags.
+var portFlags = map[string]bool{
+	"IsolateClientAddr": false, "IsolateSOCKSAuth": false,
+	"IsolateClientProtocol": false, "IsolateDestPort": false,
+	"IsolateDestAddr": false, "KeepAliveIsolateSOCKSAuth": false,
+	"IPv4Traffic": false, "IPv6Traffic": false, "PreferIPv6": false,
+	"DNSRequest": false, "OnionTraffic": false, "OnionTrafficOnly": false,
+	"CacheIPv4DNS": false, "CacheIPv6DNS": false, "CacheDNS": false,
+	"UseIPv4Cache": false, "UseIPv6Cache": false, "UseDNSCache": false,
+	"PreferIPv6Automap": false, "PreferSOCKSNoAuth": false, "ExtendedErrors": false,
+	"GroupWritable": true, "WorldWritable": true, "RelaxDirModeCheck": true,
+}
+
+// AutoPort, as Config.SocksPort or Config.ControlPort, lets Tor pick a free
+// port. The other listeners take "auto" as Port.Addr. The ports Tor picked
+// are reported by Instance.QueryListeners.
+const AutoPort = -1
+
+// DisabledPort, as Config.ControlPort, opens no control port at all, like
+// "ControlPort 0" in a torrc. Only the in-process Tor, which has its own
+// control connection, can run without one.
+const DisabledPort = -2
+
+// Port is a client listener such as a SocksPort with its flags.
+type Port struct {
+	// Addr is a port number, "address:port", "auto" or "unix:/path"
+	Addr string
+
+	// Flags are the listener's isolation and traffic flags
+	Flags []PortFlag
+
+	// SessionGroup, if positive, puts the listener in that session group.
+	// Streams from listeners in different groups never share a circuit.
+	SessionGroup int
+}
+
+// String renders the port as a torrc value, e.g. "9050 IsolateDestAddr".
+func (p Port) String() string {
+	addr := p.Addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok && strings.ContainsAny(path, " \t\"\\") {
+		addr = "unix:" + torutil.EscapeSimpleQuotedString(path)
+	}
+	parts := []string{addr}
+	for _, flag := range p.Flags {
+		parts = append(parts, string(flag))
+	}
+	if p.SessionGroup > 0 {
+		parts = append(parts, fmt.Sprintf("SessionGroup=%d", p.SessionGroup))
+	}
+	return strings.Join(parts, " ")
+}
+
+// NodeConfig restricts which relays Tor uses. Each entry is a fingerprint,
+// nickname, country code such as "{de}" or address pattern.
+type NodeConfig struct {
+	EntryNodes       []string
+	MiddleNodes      []string
+	ExitNodes        []string
+	ExcludeNodes     []string
+	ExcludeExitNodes []string
+
+	// StrictNodes makes ExcludeNodes apply even when Tor would otherwise
+	// need an excluded relay to complete a request
+	StrictNodes bool
+}
+
+// BridgeConfig makes Tor connect to the network through bridges.
+type BridgeConfig struct {
+	// Lines are Bridge lines, e.g. "obfs4 192.0.2.1:443 FINGERPRINT cert=..."
+	// or "192.0.2.1:9001". Setting any enables UseBridges.
+	Lines []string
+
+	// Transports are the pluggable transports used by the bridges
+	Transports []TransportPlugin
+}
+
+// TransportPlugin is a client pluggable transport executable.
+type TransportPlugin struct {
+	// Names are the transports provided, e.g. "obfs4" or "snowflake"
+	Names []string
+
+	// Path is the transport executable and Args its arguments
+	Path string
+	Args []string
+}
+
+// ProxyConfig makes Tor reach the network through a proxy. Only one of
+// HTTPS, Socks4 and Socks5 may be set.
+type ProxyConfig struct {
+	// HTTPS is an HTTP CONNECT proxy "host:port" and HTTPSAuthenticator its
+	// "username:password"
+	HTTPS              string
+	HTTPSAuthenticator string
+
+	// Socks4 is a SOCKS 4 proxy "host:port"
+	Socks4 string
+
+	// Socks5 is a SOCKS 5 proxy "host:port" with optional credentials
+	Socks5         string
+	Socks5Username string
+	Socks5Password string
+}
+
+// BandwidthConfig limits Tor's bandwidth, in bytes per second. Zero keeps
+// Tor's default of 1 GByte.
+type BandwidthConfig struct {
+	Rate  int64
+	Burst int64
+}
+
+// OnionServiceConfig is an onion service kept in a directory on disk, the
+// equivalent of a HiddenServiceDir block. Only v3 services are supported.
+type OnionServiceConfig struct {
+	// Dir is the service directory holding its keys and hostname
+	Dir string
+
+	// Ports map virtual ports to local targets
+	Ports []OnionPort
+
+	// MaxStreams limits streams per rendezvous circuit (0 for no limit);
+	// MaxStreamsCloseCircuit closes the circuit when it is exceeded
+	MaxStreams             int
+	MaxStreamsCloseCircuit bool
+
+	// NumIntroductionPoints is between 3 and 20, or 0 for Tor's default
+	NumIntroductionPoints int
+
+	// AllowUnknownPorts keeps circuits open for ports not in Ports
+	AllowUnknownPorts bool
+
+	// Options are further per-service HiddenService* options with no typed
+	// field, such as HiddenServiceEnableIntroDoSDefense
+	Options []Option
+}
+
+// OnionPort maps a virtual onion service port to a local target.
+type OnionPort struct {
+	// Virtual is the port clients connect to
+	Virtual int
+
+	// Target is a port, "address:port" or "unix:/path". It defaults to
+	// Virtual on 127.0.0.1.
+	Target string
+}
+
+// String renders the port as a HiddenServicePort value, e.g. "80 8080".
+func (p OnionPort) String() string {
+	if p.Target == "" {
+		return strconv.Itoa(p.Virtual)
+	}
+	return fmt.Sprintf("%d %s", p.Virtual, p.Target)
+}
+
+// LogConfig is a Tor log destination, the equivalent of a Log line.
+type LogConfig struct {
+	// Severity is a severity such as "notice" or a range such as "info-err"
+	Severity string
+
+	// Target is "stdout", "stderr", "syslog" or "file /path/to/log"
+	Target string
+}
+
+// DirectoryConfig controls how Tor fetches and stores directory
+// information.
+type DirectoryConfig struct {
+	// CacheDirectory stores cached directory documents, if not DataDir
+	CacheDirectory string
+
+	// DirAuthorities replaces the default directory authorities and
+	// FallbackDirs the default fallback directories, mainly for testing
+	// networks
+	DirAuthorities []string
+	FallbackDirs   []string
+
+	// FetchDirInfoEarly fetches directory information like a relay would;
+	// FetchDirInfoExtraEarly, which requires it, fetches it even earlier
+	FetchDirInfoEarly      bool
+	FetchDirInfoExtraEarly bool
+
+	// FetchUselessDescriptors and DownloadExtraInfo fetch documents a
+	// client does not need
+	FetchUselessDescriptors bool
+	DownloadExtraInfo       bool
+
+	// AvoidDiskWrites makes Tor write to its data directory less often
+	AvoidDiskWrites bool
+}
+
+// typedOptions are options that Config sets from a typed field. They are
+// rejected in Config.Options so the two can never conflict.
+var typedOptions = map[string]string{
+	"DataDirectory":                       "DataDir",
+	"SocksPort":                           "SocksPort or SocksPorts",
+	"ControlPort":                         "ControlPort",
+	"DNSPort":                             "DNSPorts",
+	"TransPort":                           "TransPorts",
+	"HTTPTunnelPort":                      "HTTPTunnelPorts",
+	"ClientOnly":                          "ClientOnly",
+	"ShutdownWaitLength":                  "ShutdownWait",
+	"EntryNodes":                          "Nodes",
+	"MiddleNodes":                         "Nodes",
+	"ExitNodes":                           "Nodes",
+	"ExcludeNodes":                        "Nodes",
+	"ExcludeExitNodes":                    "Nodes",
+	"StrictNodes":                         "Nodes",
+	"UseBridges":                          "Bridges",
+	"Bridge":                              "Bridges",
+	"ClientTransportPlugin":               "Bridges",
+	"HTTPSProxy":                          "Proxy",
+	"HTTPSProxyAuthenticator":             "Proxy",
+	"Socks4Proxy":                         "Proxy",
+	"Socks5Proxy":                         "Proxy",
+	"Socks5ProxyUsername":                 "Proxy",
+	"Socks5ProxyPassword":                 "Proxy",
+	"BandwidthRate":                       "Bandwidth",
+	"BandwidthBurst":                      "Bandwidth",
+	"HiddenServiceDir":                    "OnionServices",
+	"HiddenServicePort":                   "OnionServices",
+	"HiddenServiceVersion":                "OnionServices",
+	"HiddenServiceMaxStreams":             "OnionServices",
+	"HiddenServiceMaxStreamsCloseCircuit": "OnionServices",
+	"HiddenServiceNumIntroductionPoints":  "OnionServices",
+	"HiddenServiceAllowUnknownPorts":      "OnionServices",
+	"Log":                                 "Logs",
+	"CacheDirectory":                      "Directory",
+	"DirAuthority":                        "Directory",
+	"FallbackDir":                         "Directory",
+	"FetchDirInfoEarly":                   "Directory",
+	"FetchDirInfoExtraEarly":              "Directory",
+	"FetchUselessDescriptors":             "Directory",
+	"DownloadExtraInfo":                   "Directory",
+	"AvoidDiskWrites":                     "Directory",
+}
+
+// defaultBandwidth is Tor's default BandwidthRate and BandwidthBurst
+const defaultBandwidth = 1 << 30
+
+// Args checks the configuration and converts it to Tor command-line
+// arguments. Unknown, malformed or conflicting options are reported as
+// *ConfigError values joined into a single error.
+func (c *Config) Args() ([]string, error) {
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	return c.BuildExtraArgs(), nil
+}
+
+// TorOptions returns the configuration as Tor options in the order they are
+// passed to Tor. The data directory is not included; it is passed to Tor
+// separately.
+func (c *Config) TorOptions() []Option {
+	var opts []Option
+	add := func(key, val string) {
+		opts = append(opts, Option{Key: key, Value: val})
+	}
+	flag := func(key string, set bool) {
+		if set {
+			add(key, "1")
+		}
+	}
+	nodes := func(key string, list []string) {
+		if len(list) > 0 {
+			add(key, strings.Join(list, ","))
+		}
+	}
+	ports := func(key string, list []Port) {
+		for _, p := range list {
+			add(key, p.String())
+		}
+	}
+
+	if c.SocksPort == AutoPort {
+		add("SocksPort", "auto")
+	} else if c.SocksPort != 0 || len(c.SocksPorts) == 0 {
+		add("SocksPort", strconv.Itoa(c.SocksPort))
+	}
+	ports("SocksPort", c.SocksPorts)
+	if c.ControlPort > 0 {
+		add("ControlPort", strconv.Itoa(c.ControlPort))
+	} else if c.ControlPort == DisabledPort {
+		add("ControlPort", "0")
+	} else if c.ControlPort == AutoPort || len(c.ControlPorts) == 0 {
+		add("ControlPort", "auto")
+	}
+	ports("ControlPort", c.ControlPorts)
+	ports("DNSPort", c.DNSPorts)
+	ports("TransPort", c.TransPorts)
+	ports("HTTPTunnelPort", c.HTTPTunnelPorts)
+	flag("ClientOnly", c.ClientOnly)
+	if c.ShutdownWait > 0 {
+		add("ShutdownWaitLength", strconv.Itoa(int(c.ShutdownWait.Seconds())))
+	}
+
+	nodes("EntryNodes", c.Nodes.EntryNodes)
+	nodes("MiddleNodes", c.Nodes.MiddleNodes)
+	nodes("ExitNodes", c.Nodes.ExitNodes)
+	nodes("ExcludeNodes", c.Nodes.ExcludeNodes)
+	nodes("ExcludeExitNodes", c.Nodes.ExcludeExitNodes)
+	flag("StrictNodes", c.Nodes.StrictNodes)
+
+	flag("UseBridges", len(c.Bridges.Lines) > 0)
+	for _, line := range c.Bridges.Lines {
+		add("Bridge", line)
+	}
+	for _, t := range c.Bridges.Transports {
+		add("ClientTransportPlugin", t.String())
+	}
+
+	proxy := []Option{
+		{"HTTPSProxy", c.Proxy.HTTPS},
+		{"HTTPSProxyAuthenticator", c.Proxy.HTTPSAuthenticator},
+		{"Socks4Proxy", c.Proxy.Socks4},
+		{"Socks5Proxy", c.Proxy.Socks5},
+		{"Socks5ProxyUsername", c.Proxy.Socks5Username},
+		{"Socks5ProxyPassword", c.Proxy.Socks5Password},
+	}
+	for _, opt := range proxy {
+		if opt.Value != "" {
+			opts = append(opts, opt)
+		}
+	}
+
+	if c.Bandwidth.Rate > 0 {
+		add("BandwidthRate", fmt.Sprintf("%d bytes", c.Bandwidth.Rate))
+	}
+	if c.Bandwidth.Burst > 0 {
+		add("BandwidthBurst", fmt.Sprintf("%d bytes", c.Bandwidth.Burst))
+	}
+
+	if c.Directory.CacheDirectory != "" {
+		add("CacheDirectory", c.Directory.CacheDirectory)
+	}
+	for _, line := range c.Directory.DirAuthorities {
+		add("DirAuthority", line)
+	}
+	for _, line := range c.Directory.FallbackDirs {
+		add("FallbackDir", line)
+	}
+	flag("FetchDirInfoEarly", c.Directory.FetchDirInfoEarly)
+	flag("FetchDirInfoExtraEarly", c.Directory.FetchDirInfoExtraEarly)
+	flag("FetchUselessDescriptors", c.Directory.FetchUselessDescriptors)
+	flag("DownloadExtraInfo", c.Directory.DownloadExtraInfo)
+	flag("AvoidDiskWrites", c.Directory.AvoidDiskWrites)
+
+	for _, l := range c.Logs {
+		add("Log", l.Severity+" "+l.Target)
+	}
+
+	// Per-service options must follow their HiddenServiceDir
+	for _, s := range c.OnionServices {
+		add("HiddenServiceDir", s.Dir)
+		add("HiddenServiceVersion", "3")
+		for _, p := range s.Ports {
+			add("HiddenServicePort", p.String())
+		}
+		if s.MaxStreams > 0 {
+			add("HiddenServiceMaxStreams", strconv.Itoa(s.MaxStreams))
+		}
+		flag("HiddenServiceMaxStreamsCloseCircuit", s.MaxStreamsCloseCircuit)
+		if s.NumIntroductionPoints > 0 {
+			add("HiddenServiceNumIntroductionPoints", strconv.Itoa(s.NumIntroductionPoints))
+		}
+		flag("HiddenServiceAllowUnknownPorts", s.AllowUnknownPorts)
+		opts = append(opts, s.Options...)
+	}
+
+	return append(opts, c.Options...)
+}
+
+// String renders the plugin as a ClientTransportPlugin value.
+func (t TransportPlugin) String() string {
+	return strings.Join(append([]string{strings.Join(t.Names, ","), "exec", t.Path}, t.Args...), " ")
+}
+
+// Check reports unknown, malformed and conflicting options without
+// starting Tor. Every problem is a *ConfigError; they are joined into a
+// single error. Check does not consult Tor itself.
+func (c *Config) Check() error {
+	var errs []error
+	report := func(option, value string, err error) {
+		errs = append(errs, &ConfigError{Option: option, Value: value, Err: err})
+	}
+	invalid := func(option, value, format string, args ...any) {
+		report(option, value, fmt.Errorf("%w: "+format, append([]any{ErrInvalidValue}, args...)...))
+	}
+	conflict := func(option, value, format string, args ...any) {
+		report(option, value, fmt.Errorf("%w: "+format, append([]any{ErrConflictingOptions}, args...)...))
+	}
+
+	// Listeners
+	if c.SocksPort < AutoPort || c.SocksPort > 65535 {
+		invalid("SocksPort", strconv.Itoa(c.SocksPort), "port must be between 0 and 65535 or AutoPort")
+	}
+	if c.ControlPort < DisabledPort || c.ControlPort > 65535 {
+		invalid("ControlPort", strconv.Itoa(c.ControlPort), "port must be between 0 and 65535, AutoPort or DisabledPort")
+	} else if c.ControlPort == DisabledPort && len(c.ControlPorts) > 0 {
+		conflict("ControlPort", "0", "ControlPorts are set but the control port is disabled")
+	}
+	seen := map[string]string{}
+	if c.SocksPort > 0 {
+		seen[strconv.Itoa(c.SocksPort)] = "SocksPort"
+	}
+	if c.ControlPort > 0 {
+		seen[strconv.Itoa(c.ControlPort)] = "ControlPort"
+	}
+	checkPorts := func(key string, list []Port) {
+		for _, p := range list {
+			err := checkPort(p)
+			if err == nil && key == "ControlPort" {
+				err = checkControlPort(p)
+			}
+			if err != nil {
+				report(key, p.String(), err)
+				continue
+			}
+			if other, ok := seen[p.Addr]; ok && p.Addr != "auto" {
+				conflict(key, p.String(), "%s already listens on %s", other, p.Addr)
+			}
+			seen[p.Addr] = key
+		}
+	}
+	checkPorts("SocksPort", c.SocksPorts)
+	checkPorts("ControlPort", c.ControlPorts)
+	checkPorts("DNSPort", c.DNSPorts)
+	checkPorts("TransPort", c.TransPorts)
+	checkPorts("HTTPTunnelPort", c.HTTPTunnelPorts)
+	if c.ShutdownWait < 0 {
+		invalid("ShutdownWaitLength", c.ShutdownWait.String(), "must not be negative")
+	} else if c.ShutdownWait%time.Second != 0 {
+		invalid("ShutdownWaitLength", c.ShutdownWait.String(), "must be a whole number of seconds")
+	}
+
+	// Node selection
+	for _, n := range []struct {
+		key  string
+		list []string
+	}{
+		{"EntryNodes", c.Nodes.EntryNodes},
+		{"MiddleNodes", c.Nodes.MiddleNodes},
+		{"ExitNodes", c.Nodes.ExitNodes},
+		{"ExcludeNodes", c.Nodes.ExcludeNodes},
+		{"ExcludeExitNodes", c.Nodes.ExcludeExitNodes},
+	} {
+		for _, node := range n.list {
+			if node == "" || strings.ContainsAny(node, ", \t") {
+				invalid(n.key, node, "node must be a single fingerprint, nickname, country code or address")
+			}
+		}
+	}
+
+	// Bridges
+	transports := map[string]bool{}
+	for _, t := range c.Bridges.Transports {
+		if len(t.Names) == 0 || t.Path == "" {
+			invalid("ClientTransportPlugin", t.String(), "transport names and path are required")
+		}
+		for _, name := range t.Names {
+			transports[name] = true
+		}
+	}
+	for _, line := range c.Bridges.Lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			invalid("Bridge", line, "empty bridge line")
+			continue
+		}
+		if name := fields[0]; !strings.Contains(name, ":") {
+			if len(fields) < 2 {
+				invalid("Bridge", line, "missing bridge address")
+			} else if !transports[name] {
+				conflict("Bridge", line, "no ClientTransportPlugin provides transport %q", name)
+			}
+		}
+	}
+
+	// Proxies
+	var proxies []string
+	for _, opt := range []Option{
+		{"HTTPSProxy", c.Proxy.HTTPS},
+		{"Socks4Proxy", c.Proxy.Socks4},
+		{"Socks5Proxy", c.Proxy.Socks5},
+	} {
+		if opt.Value == "" {
+			continue
+		}
+		proxies = append(proxies, opt.Key)
+		if _, port, err := net.SplitHostPort(opt.Value); err != nil || port == "" {
+			invalid(opt.Key, opt.Value, "proxy must be host:port")
+		}
+	}
+	if len(proxies) > 1 {
+		conflict(proxies[1], "", "only one of %s may be set", strings.Join(proxies, ", "))
+	}
+	if c.Proxy.HTTPSAuthenticator != "" && c.Proxy.HTTPS == "" {
+		conflict("HTTPSProxyAuthenticator", "", "requires HTTPSProxy")
+	}
+	if (c.Proxy.Socks5Username != "" || c.Proxy.Socks5Password != "") && c.Proxy.Socks5 == "" {
+		conflict("Socks5ProxyUsername", "", "requires Socks5Proxy")
+	}
+	if (c.Proxy.Socks5Username == "") != (c.Proxy.Socks5Password == "") {
+		conflict("Socks5ProxyPassword", "", "Socks5ProxyUsername and Socks5ProxyPassword must be set together")
+	}
+
+	// Bandwidth
+	rate, burst := c.Bandwidth.Rate, c.Bandwidth.Burst
+	if rate < 0 || burst < 0 {
+		invalid("BandwidthRate", "", "bandwidth must not be negative")
+	} else {
+		if rate == 0 {
+			rate = defaultBandwidth
+		}
+		if burst == 0 {
+			burst = defaultBandwidth
+		}
+		if burst < rate {
+			conflict("BandwidthBurst", strconv.FormatInt(burst, 10), "must be at least BandwidthRate (%d)", rate)
+		}
+	}
+
+	// Directory
+	if c.Directory.FetchDirInfoExtraEarly && !c.Directory.FetchDirInfoEarly {
+		conflict("FetchDirInfoExtraEarly", "1", "requires FetchDirInfoEarly")
+	}
+
+	// Logging
+	for _, l := range c.Logs {
+		value := l.Severity + " " + l.Target
+		if err := checkLogSeverity(l.Severity); err != nil {
+			report("Log", value, err)
+		}
+		target, path, _ := strings.Cut(l.Target, " ")
+		switch target {
+		case "stdout", "stderr", "syslog":
+		case "file":
+			if strings.TrimSpace(path) == "" {
+				invalid("Log", value, "file target needs a path")
+			}
+		default:
+			invalid("Log", value, "target must be stdout, stderr, syslog or file PATH")
+		}
+	}
+
+	// Onion services
+	dirs := map[string]bool{}
+	for _, s := range c.OnionServices {
+		if s.Dir == "" {
+			invalid("HiddenServiceDir", "", "directory is required")
+		} else if dirs[s.Dir] {
+			conflict("HiddenServiceDir", s.Dir, "directory used by more than one service")
+		}
+		dirs[s.Dir] = true
+		if len(s.Ports) == 0 {
+			invalid("HiddenServicePort", s.Dir, "service has no ports")
+		}
+		for _, p := range s.Ports {
+			if p.Virtual < 1 || p.Virtual > 65535 {
+				invalid("HiddenServicePort", p.String(), "virtual port must be between 1 and 65535")
+			}
+			if p.Target != "" {
+				if err := checkPortAddr(p.Target); err != nil || p.Target == "auto" {
+					invalid("HiddenServicePort", p.String(), "target must be a port, address:port or unix:/path")
+				}
+			}
+		}
+		if s.MaxStreams < 0 || s.MaxStreams > 65535 {
+			invalid("HiddenServiceMaxStreams", strconv.Itoa(s.MaxStreams), "must be between 0 and 65535")
+		}
+		if n := s.NumIntroductionPoints; n != 0 && (n < 3 || n > 20) {
+			invalid("HiddenServiceNumIntroductionPoints", strconv.Itoa(n), "must be between 3 and 20")
+		}
+		for _, opt := range s.Options {
+			name, _ := canonicalOption(opt.Key)
+			if !perServiceOptions[name] {
+				report(opt.Key, opt.Value, fmt.Errorf("%w: not a per-service option", ErrInvalidValue))
+			} else if _, ok := typedOptions[name]; ok {
+				conflict(name, opt.Value, "set with OnionServiceConfig fields instead")
+			}
+		}
+	}
+
+	// Everything else
+	for _, opt := range c.Options {
+		name, known := canonicalOption(opt.Key)
+		if !known {
+			report(opt.Key, opt.Value, ErrUnknownOption)
+		} else if field, ok := typedOptions[name]; ok {
+			conflict(name, opt.Value, "set with Config.%s instead", field)
+		} else if perServiceOptions[name] {
+			conflict(name, opt.Value, "set in OnionServiceConfig.Options instead")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkPort checks a listener's address and flags.
+func checkPort(p Port) error {
+	if p.Addr == "0" {
+		return fmt.Errorf("%w: use an empty list to disable a listener", ErrInvalidValue)
+	}
+	if err := checkPortAddr(p.Addr); err != nil {
+		return err
+	}
+	if p.SessionGroup < 0 {
+		return fmt.Errorf("%w: SessionGroup must not be negative", ErrInvalidValue)
+	}
+
+	unix := strings.HasPrefix(p.Addr, "unix:")
+	negated := map[string]bool{}
+	for _, flag := range p.Flags {
+		base, no, ok := portFlagBase(string(flag))
+		if !ok {
+			return fmt.Errorf("%w: unknown port flag %q", ErrInvalidValue, flag)
+		}
+		if portFlags[base] && !unix {
+			return fmt.Errorf("%w: %s only applies to unix socket listeners", ErrConflictingOptions, flag)
+		}
+		if prev, seen := negated[base]; seen && prev != no {
+			return fmt.Errorf("%w: %s and No%s", ErrConflictingOptions, base, base)
+		}
+		negated[base] = no
+	}
+	if only, ok := negated["OnionTrafficOnly"]; ok && !only && negated["OnionTraffic"] {
+		return fmt.Errorf("%w: OnionTrafficOnly and NoOnionTraffic", ErrConflictingOptions)
+	}
+	return nil
+}
+
+// checkControlPort checks the flags of a control listener, which only takes
+// the unix socket flags.
+func checkControlPort(p Port) error {
+	if p.SessionGroup > 0 {
+		return fmt.Errorf("%w: SessionGroup only applies to client listeners", ErrConflictingOptions)
+	}
+	for _, flag := range p.Flags {
+		if base, _, _ := portFlagBase(string(flag)); !portFlags[base] {
+			return fmt.Errorf("%w: %s only applies to client listeners", ErrConflictingOptions, flag)
+		}
+	}
+	return nil
+}
+
+// portFlagBase returns the canonical name of a port flag without its "No"
+// prefix and whether it was negated. Tor matches flags case-insensitively.
+func portFlagBase(flag string) (base string, negated bool, ok bool) {
+	for name := range portFlags {
+		if strings.EqualFold(flag, name) {
+			return name, false, true
+		}
+	}
+	if len(flag) > 2 && strings.EqualFold(flag[:2], "no") {
+		for name := range portFlags {
+			if strings.EqualFold(flag[2:], name) {
+				return name, true, true
+			}
+		}
+	}
+	return "", false, false
+}
+
+// checkPortAddr checks a listener address: a port, "address:port", "auto"
+// or "unix:/path".
+func checkPortAddr(addr string) error {
+	if addr == "auto" {
+		return nil
+	}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("%w: unix socket path is empty", ErrInvalidValue)
+		}
+		return nil
+	}
+
+	port := addr
+	if i := strings.LastIndexByte(addr, ':'); i >= 0 {
+		if addr[:i] == "" {
+			return fmt.Errorf("%w: address is empty in %q", ErrInvalidValue, addr)
+		}
+		port = addr[i+1:]
+	}
+	if port == "auto" {
+		return nil
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: invalid port in %q", ErrInvalidValue, addr)
+	}
+	return nil
+}
+
+// logSeverities are Tor's log severities, lowest first
+var logSeverities = []string{"debug", "info", "notice", "warn", "err"}
+
+// checkLogSeverity checks a Log severity such as "notice" or "info-err".
+func checkLogSeverity(severity string) error {
+	index := func(s string) int {
+		for i, known := range logSeverities {
+			if s == known {
+				return i
+			}
+		}
+		return -1
+	}
+	// Skip a leading list of log domains such as "[~net]"
+	if strings.HasPrefix(severity, "[") {
+		if end := strings.IndexByte(severity, ']'); end > 0 {
+			severity = severity[end+1:]
+		}
+	}
+	min, max, ranged := strings.Cut(severity, "-")
+	lo, hi := index(min), index(max)
+	if lo < 0 || (ranged && hi < 0) {
+		return fmt.Errorf("%w: unknown severity %q", ErrInvalidValue, severity)
+	}
+	if ranged && hi < lo {
+		return fmt.Errorf("%w: severity range %q is reversed", ErrInvalidValue, severity)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package embed
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigArgs(t *testing.T) {
+	args, err := DefaultConfig().Args()
+	if err != nil {
+		t.Fatalf("DefaultConfig should be valid: %v", err)
+	}
+	want := []string{"--SocksPort", "9050", "--ControlPort", "auto", "--ClientOnly", "1"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("Args() = %q, want %q", args, want)
+	}
+}
+
+func TestTorOptionsRendering(t *testing.T) {
+	config := &Config{
+		SocksPorts: []Port{
+			{Addr: "127.0.0.1:9150", Flags: []PortFlag{IsolateDestAddr, OnionTrafficOnly}, SessionGroup: 2},
+		},
+		ControlPort:  9051,
+		ShutdownWait: 5 * time.Second,
+		Nodes:        NodeConfig{ExitNodes: []string{"{de}", "{nl}"}, StrictNodes: true},
+		Bridges: BridgeConfig{
+			Lines:      []string{"obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0"},
+			Transports: []TransportPlugin{{Names: []string{"obfs4"}, Path: "/usr/bin/lyrebird"}},
+		},
+		Bandwidth: BandwidthConfig{Rate: 1 << 20, Burst: 2 << 20},
+		OnionServices: []OnionServiceConfig{
+			{Dir: "/var/lib/tor/web", Ports: []OnionPort{{Virtual: 80, Target: "127.0.0.1:8080"}}},
+		},
+		Options: []Option{{"CircuitBuildTimeout", "30"}},
+	}
+
+	want := []Option{
+		{"SocksPort", "127.0.0.1:9150 IsolateDestAddr OnionTrafficOnly SessionGroup=2"},
+		{"ControlPort", "9051"},
+		{"ShutdownWaitLength", "5"},
+		{"ExitNodes", "{de},{nl}"},
+		{"StrictNodes", "1"},
+		{"UseBridges", "1"},
+		{"Bridge", "obfs4 192.0.2.1:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=abc iat-mode=0"},
+		{"ClientTransportPlugin", "obfs4 exec /usr/bin/lyrebird"},
+		{"BandwidthRate", "1048576 bytes"},
+		{"BandwidthBurst", "2097152 bytes"},
+		{"HiddenServiceDir", "/var/lib/tor/web"},
+		{"HiddenServiceVersion", "3"},
+		{"HiddenServicePort", "80 127.0.0.1:8080"},
+		{"CircuitBuildTimeout", "30"},
+	}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if got := config.TorOptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("TorOptions() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestConfigCheckRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		option string
+		kind   error
+	}{
+		{"unknown option", Config{Options: []Option{{"SocksPortt", "9050"}}},
+			"SocksPortt", ErrUnknownOption},
+		{"typed option", Config{Options: []Option{{"socksport", "9050"}}},
+			"SocksPort", ErrConflictingOptions},
+		{"bad port", Config{SocksPorts: []Port{{Addr: "127.0.0.1:70000"}}},
+			"SocksPort", ErrInvalidValue},
+		{"duplicate port", Config{SocksPort: 9050, SocksPorts: []Port{{Addr: "9050"}}},
+			"SocksPort", ErrConflictingOptions},
+		{"unknown flag", Config{SocksPorts: []Port{{Addr: "9150", Flags: []PortFlag{"IsolateEverything"}}}},
+			"SocksPort", ErrInvalidValue},
+		{"negated flag", Config{SocksPorts: []Port{{Addr: "9150", Flags: []PortFlag{IsolateSOCKSAuth, NoIsolateSOCKSAuth}}}},
+			"SocksPort", ErrConflictingOptions},
+		{"unix flag on tcp", Config{SocksPorts: []Port{{Addr: "9150", Flags: []PortFlag{GroupWritable}}}},
+			"SocksPort", ErrConflictingOptions},
+		{"two proxies", Config{Proxy: ProxyConfig{HTTPS: "proxy:3128", Socks5: "proxy:1080"}},
+			"Socks5Proxy", ErrConflictingOptions},
+		{"missing transport", Config{Bridges: BridgeConfig{Lines: []string{"snowflake 192.0.2.3:80"}}},
+			"Bridge", ErrConflictingOptions},
+		{"burst below rate", Config{Bandwidth: BandwidthConfig{Rate: 2000, Burst: 1000}},
+			"BandwidthBurst", ErrConflictingOptions},
+		{"extra early", Config{Directory: DirectoryConfig{FetchDirInfoExtraEarly: true}},
+			"FetchDirInfoExtraEarly", ErrConflictingOptions},
+		{"bad severity", Config{Logs: []LogConfig{{Severity: "loud", Target: "stderr"}}},
+			"Log", ErrInvalidValue},
+		{"service without ports", Config{OnionServices: []OnionServiceConfig{{Dir: "/tmp/hs"}}},
+			"HiddenServicePort", ErrInvalidValue},
+		{"partial seconds", Config{ShutdownWait: 500 * time.Millisecond},
+			"ShutdownWaitLength", ErrInvalidValue},
+		{"shared service dir", Config{OnionServices: []OnionServiceConfig{
+			{Dir: "/tmp/hs", Ports: []OnionPort{{Virtual: 80}}},
+			{Dir: "/tmp/hs", Ports: []OnionPort{{Virtual: 22}}},
+		}}, "HiddenServiceDir", ErrConflictingOptions},
+	}
+
+	for _, tt := range tests {
+		err := tt.config.Check()
+		var configErr *ConfigError
+		if !errors.As(err, &configErr) {
+			t.Errorf("%s: expected ConfigError, got %v", tt.name, err)
+			continue
+		}
+		if configErr.Option != tt.option || !errors.Is(err, tt.kind) {
+			t.Errorf("%s: got %v, want %s with %v", tt.name, err, tt.option, tt.kind)
+		}
+	}
+}
+
+func TestCanonicalOption(t *testing.T) {
+	if name, ok := canonicalOption("exitnodes"); !ok || name != "ExitNodes" {
+		t.Errorf("canonicalOption(exitnodes) = %s, %v", name, ok)
+	}
+	if _, ok := canonicalOption("__OwningControllerProcess"); !ok {
+		t.Error("Expected hidden options to be accepted")
+	}
+	if _, ok := canonicalOption("NoSuchOption"); ok {
+		t.Error("Expected unknown option to be rejected")
+	}
+}
+
+func TestAutoPorts(t *testing.T) {
+	config := DefaultConfig()
+	config.SocksPort = AutoPort
+	config.ControlPort = AutoPort
+	config.ControlPorts = []Port{{Addr: "unix:/run/control"}}
+	config.DNSPorts = []Port{{Addr: "127.0.0.1:auto"}}
+	args, err := config.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	want := []string{"--SocksPort", "auto", "--ControlPort", "auto", "--ControlPort", "unix:/run/control",
+		"--DNSPort", "127.0.0.1:auto", "--ClientOnly", "1"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("Args() = %q, want %q", args, want)
+	}
+
+	loaded, err := ConfigFromOptions(config.TorOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.SocksPort != AutoPort || loaded.ControlPort != AutoPort || len(loaded.ControlPorts) != 1 {
+		t.Errorf("Round trip mismatch: %+v", loaded)
+	}
+
+	config.SocksPort = -2
+	if err := config.Check(); !errors.Is(err, ErrInvalidValue) {
+		t.Errorf("Expected -2 to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// dataDirName is the directory created for Tor under the user's data
+// directory.
+const dataDirName = "embedded-tor"
+
+// lockFileName is the file Tor locks in its data directory while running.
+const lockFileName = "lock"
+
+// DefaultDataDir returns the per-user data directory used by DefaultConfig:
+// embedded-tor under $XDG_DATA_HOME (~/.local/share by default) on Unix
+// systems, or under os.UserConfigDir on macOS and Windows. If the user's
+// home directory is unknown, a per-user directory under os.TempDir is
+// returned instead.
+func DefaultDataDir() string {
+	var base string
+	switch runtime.GOOS {
+	case "darwin", "ios", "windows", "plan9":
+		base, _ = os.UserConfigDir()
+	default:
+		if base = os.Getenv("XDG_DATA_HOME"); !filepath.IsAbs(base) {
+			base = ""
+			if home, err := os.UserHomeDir(); err == nil {
+				base = filepath.Join(home, ".local", "share")
+			}
+		}
+	}
+	if base == "" {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("%s-%d", dataDirName, os.Getuid()))
+	}
+	return filepath.Join(base, dataDirName)
+}
+
+// prepareDataDir creates dir with owner-only permissions if it does not
+// exist and verifies that it is a directory Tor can use: owned by the
+// current user, writable and not locked by another Tor. Group and world
+// permissions on an existing directory are removed, as Tor itself would.
+func prepareDataDir(dir string) error {
+	if dir == "" {
+		return &DataDirError{Dir: dir, Err: errors.New("not set")}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return &DataDirError{Dir: dir, Err: err}
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return &DataDirError{Dir: dir, Err: err}
+	}
+	if !info.IsDir() {
+		return &DataDirError{Dir: dir, Err: errors.New("not a directory")}
+	}
+	if err := checkDataDirOwner(info); err != nil {
+		return &DataDirError{Dir: dir, Err: err}
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return &DataDirError{Dir: dir, Err: err}
+		}
+	}
+
+	// Probe writability up front rather than letting Tor fail later
+	f, err := os.CreateTemp(dir, ".write-test-")
+	if err != nil {
+		return &DataDirError{Dir: dir, Err: fmt.Errorf("not writable: %w", err)}
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return &DataDirError{Dir: dir, Err: err}
+	}
+	return checkDataDirLock(dir)
+}
+
+// checkDataDirLock returns a *DataDirError wrapping ErrDataDirInUse if a
+// running Tor holds the lock file in dir.
+func checkDataDirLock(dir string) error {
+	locked, err := isLocked(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return &DataDirError{Dir: dir, Err: fmt.Errorf("failed to check lock: %w", err)}
+	}
+	if locked {
+		return &DataDirError{Dir: dir, Err: ErrDataDirInUse}
+	}
+	return nil
+}
+
+// newEphemeralDataDir creates a private temporary data directory.
+func newEphemeralDataDir() (string, error) {
+	dir, err := os.MkdirTemp("", dataDirName+"-")
+	if err != nil {
+		return "", &DataDirError{Dir: os.TempDir(), Err: err}
+	}
+	return dir, nil
+}
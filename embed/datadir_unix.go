@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkDataDirOwner fails if the directory is not owned by the effective
+// user, which Tor refuses.
+func checkDataDirOwner(info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if uid := os.Geteuid(); int(st.Uid) != uid {
+		return fmt.Errorf("owned by uid %d, not by the current user (uid %d)", st.Uid, uid)
+	}
+	return nil
+}
+
+// isLocked tries to take the lock Tor holds on its lock file, releasing it
+// again if it succeeds.
+func isLocked(path string) (bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package embed
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDataDirInUse(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := os.Create(filepath.Join(dir, lockFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	// An unlocked lock file is left behind by a Tor that has exited
+	if err := prepareDataDir(dir); err != nil {
+		t.Fatalf("prepareDataDir failed: %v", err)
+	}
+
+	// Lock it the way a running Tor does
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	var dirErr *DataDirError
+	if err := prepareDataDir(dir); !errors.Is(err, ErrDataDirInUse) || !errors.As(err, &dirErr) {
+		t.Errorf("Expected ErrDataDirInUse, got %v", err)
+	}
+	if _, err := NewInstance().StartTor(t.Context(), dir); !errors.Is(err, ErrDataDirInUse) {
+		t.Errorf("Expected StartTor to fail with ErrDataDirInUse, got %v", err)
+	}
+
+	// Tor appends to the microdescriptor journal in place, so a live
+	// export leaves it out
+	for _, name := range []string{microdescsFile, microdescsJournal} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("onion-key\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if err := ExportState(dir, &archive, nil); err != nil {
+		t.Fatal(err)
+	}
+	exported := t.TempDir()
+	if err := ImportState(exported, bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(exported, microdescsFile)); err != nil {
+		t.Errorf("Expected %s to be exported: %v", microdescsFile, err)
+	}
+	if _, err := os.Stat(filepath.Join(exported, microdescsJournal)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be left out of a live export", microdescsJournal)
+	}
+	if err := ImportState(dir, &archive); !errors.Is(err, ErrDataDirInUse) {
+		t.Errorf("Expected ImportState to fail with ErrDataDirInUse, got %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build windows
+// +build windows
+
+package embed
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkDataDirOwner is a no-op on Windows, where the directory is protected
+// by its ACL.
+func checkDataDirOwner(info os.FileInfo) error {
+	return nil
+}
+
+// errorSharingViolation is the Windows ERROR_SHARING_VIOLATION.
+const errorSharingViolation = syscall.Errno(32)
+
+// isLocked reports whether a running Tor has the lock file open. Tor does
+// not share it for deletion, so removing it fails while Tor runs; Tor
+// creates it again on start.
+func isLocked(path string) (bool, error) {
+	err := os.Remove(path)
+	var errno syscall.Errno
+	if errors.As(err, &errno) && errno == errorSharingViolation {
+		return true, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	return false, nil
+}
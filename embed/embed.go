@@ -1,12 +1,16 @@
 // Package embed provides embedded Tor functionality for Go applications.
 // It allows you to include Tor directly in your Go binary without requiring
 // a separate Tor installation.
+//
+// When built with CGO_ENABLED=0 or the systemtor build tag, the package
+// compiles without the static Tor libraries and runs the tor executable
+// found in PATH instead; IsEmbedded then returns false.
 package embed
 
 import (
 	"context"
-	"fmt"
-	"sync/atomic"
+	"io/fs"
+	"log/slog"
 	"time"
 
 	"github.com/RelayAnon/tor-static-builder/embed/tor048"
@@ -14,21 +18,26 @@ import (
 	"github.com/cretz/bine/tor"
 )
 
-// torInstance holds the global Tor instance
-var torInstance atomic.Pointer[tor.Tor]
+// defaultInstance backs the package-level functions
+var defaultInstance = NewInstance()
 
-// onionAddress holds the current onion service address
-var onionAddress atomic.Pointer[string]
+// Default returns the Instance used by the package-level functions such as
+// StartTor and StopTor.
+func Default() *Instance {
+	return defaultInstance
+}
 
-// GetProcessCreator returns the embedded Tor process creator.
-// This should be used with bine's tor.StartConf.
+// GetProcessCreator returns the embedded Tor process creator, or a creator
+// for the system tor executable when Tor is not embedded. This should be
+// used with bine's tor.StartConf.
 func GetProcessCreator() process.Creator {
 	return tor048.NewCreator()
 }
 
-// IsEmbedded returns true, indicating that Tor is embedded in the binary.
+// IsEmbedded returns true if Tor is embedded in the binary and false if the
+// package was built to run the system tor executable.
 func IsEmbedded() bool {
-	return true
+	return tor048.Embedded
 }
 
 // GetVersion returns the Tor version string.
@@ -37,138 +46,162 @@ func GetVersion() string {
 }
 
 // StartTor starts an embedded Tor instance with the given configuration.
-// It returns the Tor instance or an error if startup fails.
+// It returns the Tor instance or an error if startup fails. It is a thin
+// wrapper over Default().StartTor.
 func StartTor(ctx context.Context, dataDir string, extraArgs ...string) (*tor.Tor, error) {
-	// Configure Tor start options
-	startConf := &tor.StartConf{
-		ProcessCreator:         GetProcessCreator(),
-		UseEmbeddedControlConn: true,
-		DataDir:                dataDir,
-		NoAutoSocksPort:        true,
-		ExtraArgs:              extraArgs,
-	}
-
-	// Start Tor
-	t, err := tor.Start(ctx, startConf)
-	if err != nil {
-		return nil, fmt.Errorf("failed to start embedded Tor: %w", err)
-	}
-
-	// Store the instance
-	torInstance.Store(t)
-	return t, nil
+	return defaultInstance.StartTor(ctx, dataDir, extraArgs...)
 }
 
 // StartTorWithBootstrap starts Tor and waits for it to bootstrap.
-// It's a convenience function that combines StartTor and EnableNetwork.
+// It's a convenience function that combines StartTor and EnableNetwork on
+// the default instance.
 func StartTorWithBootstrap(ctx context.Context, dataDir string, timeout time.Duration) (*tor.Tor, error) {
-	// Start Tor
-	t, err := StartTor(ctx, dataDir)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create timeout context for bootstrap
-	bootCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	// Enable network and wait for bootstrap
-	if err := t.EnableNetwork(bootCtx, true); err != nil {
-		t.Close()
-		return nil, fmt.Errorf("failed to bootstrap Tor: %w", err)
-	}
-
-	return t, nil
+	return defaultInstance.StartTorWithBootstrap(ctx, dataDir, timeout)
 }
 
 // GetTorInstance returns the current Tor instance if one is running.
 func GetTorInstance() *tor.Tor {
-	return torInstance.Load()
+	return defaultInstance.Tor()
 }
 
-// GetOnionAddress returns the current onion service address if one is active.
+// GetOnionAddress returns the primary onion address of the default
+// instance; see Instance.OnionAddress.
 func GetOnionAddress() string {
-	addr := onionAddress.Load()
-	if addr == nil {
-		return ""
-	}
-	return *addr
+	return defaultInstance.OnionAddress()
 }
 
-// SetOnionAddress stores the onion service address for later retrieval.
+// SetOnionAddress records the address of an onion service created outside
+// the default instance. Services created with Listen need not be recorded.
 func SetOnionAddress(addr string) {
-	onionAddress.Store(&addr)
+	defaultInstance.SetOnionAddress(addr)
 }
 
 // StopTor gracefully shuts down the Tor instance if one is running.
 func StopTor() error {
-	t := torInstance.Load()
-	if t == nil {
-		return nil
-	}
-
-	if err := t.Close(); err != nil {
-		return fmt.Errorf("failed to stop Tor: %w", err)
-	}
-
-	torInstance.Store(nil)
-	return nil
+	return defaultInstance.Stop()
 }
 
 // Config provides a simple configuration for embedded Tor.
 type Config struct {
-	// DataDir is the directory where Tor stores its data
+	// DataDir is the directory where Tor stores its data. DefaultConfig
+	// sets it to DefaultDataDir.
 	DataDir string
 
-	// SocksPort is the SOCKS proxy port (0 to disable)
+	// Ephemeral runs Tor in a new private temporary data directory, which
+	// is removed when Tor stops, instead of DataDir. AvoidDiskWrites is
+	// set so Tor writes as little as possible.
+	Ephemeral bool
+
+	// SocksPort is the SOCKS proxy port (0 to disable, AutoPort to let Tor
+	// pick a free port)
 	SocksPort int
 
-	// ControlPort is the control port (0 for auto)
+	// SocksPorts are further SOCKS listeners, each with its own flags. A
+	// unix socket such as "unix:/run/myapp/tor/socks" with GroupWritable
+	// limits the proxy to processes that can reach the socket; set
+	// SocksPort to 0 so no TCP listener is opened. See UnixSocksDialer.
+	SocksPorts []Port
+
+	// ControlPort is the control port (0 for auto unless ControlPorts is
+	// set, AutoPort for auto in any case, DisabledPort for none)
 	ControlPort int
 
+	// ControlPorts are further control listeners, typically a unix socket
+	// with GroupWritable or WorldWritable; other flags are rejected. When
+	// it is set and ControlPort is 0, no TCP control port is opened for
+	// the in-process Tor. Instances that run Tor as a separate process
+	// always open one for their own control connection.
+	ControlPorts []Port
+
+	// DNSPorts, TransPorts and HTTPTunnelPorts are DNS, transparent proxy
+	// and HTTP CONNECT listeners
+	DNSPorts        []Port
+	TransPorts      []Port
+	HTTPTunnelPorts []Port
+
 	// ClientOnly runs Tor in client-only mode
 	ClientOnly bool
 
+	// Nodes restricts the relays Tor builds circuits through
+	Nodes NodeConfig
+
+	// Bridges makes Tor connect through bridges and pluggable transports
+	Bridges BridgeConfig
+
+	// Proxy makes Tor connect through an HTTPS or SOCKS proxy
+	Proxy ProxyConfig
+
+	// Bandwidth limits Tor's bandwidth use
+	Bandwidth BandwidthConfig
+
+	// OnionServices are onion services kept in directories on disk
+	OnionServices []OnionServiceConfig
+
+	// KeyStore keeps the keys of the onion services created with
+	// ListenPersistent. If nil, keys are kept unencrypted in the onion_keys
+	// directory of the data directory, which an Ephemeral data directory
+	// does not outlive.
+	KeyStore KeyStore
+
+	// Logs are Tor's own log destinations. See also Logger.
+	Logs []LogConfig
+
+	// Directory controls directory fetching and caching
+	Directory DirectoryConfig
+
+	// Options are further Tor options with no typed field. Unknown options
+	// and options that have a typed field are rejected.
+	Options []Option
+
+	// Snapshot, if set, is a directory snapshot used to seed DataDir
+	// before Tor starts, see SeedDataDir. A stale snapshot is ignored.
+	Snapshot fs.FS
+
 	// Timeout for bootstrap process
 	BootstrapTimeout time.Duration
+
+	// OnBootstrap, if set, receives each bootstrap step and warning
+	OnBootstrap BootstrapFunc
+
+	// Logger, if set, receives Tor's log messages at or above LogLevel and
+	// Tor's own console output is silenced. Tor's notice severity maps to
+	// slog.LevelInfo, info to slog.LevelDebug and debug to
+	// slog.LevelDebug-4. Messages logged before the control connection is
+	// up are not forwarded.
+	Logger *slog.Logger
+
+	// LogLevel is the minimum level forwarded to Logger
+	LogLevel slog.Level
+
+	// ShutdownWait is Tor's ShutdownWaitLength in whole seconds (0 for
+	// Tor's default of 30 seconds). When the start context is cancelled Tor is given this long
+	// to shut down cleanly before it is halted.
+	ShutdownWait time.Duration
 }
 
-// DefaultConfig returns a sensible default configuration.
+// DefaultConfig returns a sensible default configuration. The SOCKS proxy
+// listens on Tor's standard port 9050.
 func DefaultConfig() *Config {
 	return &Config{
-		DataDir:          "/tmp/tor-data",
-		SocksPort:        0,
+		DataDir:          DefaultDataDir(),
+		SocksPort:        9050,
 		ControlPort:      0,
 		ClientOnly:       true,
 		BootstrapTimeout: 3 * time.Minute,
 	}
 }
 
-// BuildExtraArgs converts a Config to Tor command-line arguments.
+// BuildExtraArgs converts a Config to Tor command-line arguments without
+// checking it. Use Args to reject invalid configurations.
 func (c *Config) BuildExtraArgs() []string {
 	args := []string{}
-
-	if c.SocksPort == 0 {
-		args = append(args, "--SocksPort", "0")
-	} else {
-		args = append(args, "--SocksPort", fmt.Sprintf("%d", c.SocksPort))
-	}
-
-	if c.ControlPort == 0 {
-		args = append(args, "--ControlPort", "auto")
-	} else {
-		args = append(args, "--ControlPort", fmt.Sprintf("%d", c.ControlPort))
-	}
-
-	if c.ClientOnly {
-		args = append(args, "--ClientOnly", "1")
+	for _, opt := range c.TorOptions() {
+		args = append(args, "--"+opt.Key, opt.Value)
 	}
-
 	return args
 }
 
 // QuickStart provides the simplest way to start embedded Tor with defaults.
 func QuickStart(ctx context.Context) (*tor.Tor, error) {
-	config := DefaultConfig()
-	return StartTorWithBootstrap(ctx, config.DataDir, config.BootstrapTimeout)
-}
\ No newline at end of file
+	return Start(ctx, DefaultConfig())
+}
@@ -4,14 +4,26 @@ package embed
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
 )
 
+// skipIfTorHasRun skips tests that need a fresh in-process Tor. Tor can run
+// only once per process, so select a single test with -run to exercise it.
+func skipIfTorHasRun(t *testing.T) {
+	if tor048.HasRun() {
+		t.Skip("Embedded Tor already ran in this test binary")
+	}
+}
+
 func TestStartTorIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
 	}
+	skipIfTorHasRun(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
 	defer cancel()
@@ -42,6 +54,7 @@ func TestStartTorWithBootstrapIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
 	}
+	skipIfTorHasRun(t)
 
 	ctx := context.Background()
 	dataDir := t.TempDir()
@@ -66,6 +79,7 @@ func TestQuickStartIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
 	}
+	skipIfTorHasRun(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
 	defer cancel()
@@ -95,6 +109,7 @@ func TestStopTorIntegration(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration test in short mode")
 	}
+	skipIfTorHasRun(t)
 
 	ctx := context.Background()
 
@@ -125,6 +140,12 @@ func TestStopTorIntegration(t *testing.T) {
 	if err != nil {
 		t.Errorf("Stopping already stopped Tor should not error: %v", err)
 	}
+
+	// The in-process Tor cannot be started a second time
+	_, err = StartTor(ctx, t.TempDir())
+	if !errors.Is(err, ErrRestartUnsupported) {
+		t.Errorf("Expected ErrRestartUnsupported on restart, got %v", err)
+	}
 }
 
 func TestOnionAddressManagementIntegration(t *testing.T) {
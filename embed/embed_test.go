@@ -2,6 +2,8 @@ package embed
 
 import (
 	"testing"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
 )
 
 func TestGetProcessCreator(t *testing.T) {
@@ -12,6 +14,9 @@ func TestGetProcessCreator(t *testing.T) {
 }
 
 func TestIsEmbedded(t *testing.T) {
+	if !tor048.Embedded {
+		t.Skip("IsEmbedded requires built libraries")
+	}
 	if !IsEmbedded() {
 		t.Fatal("IsEmbedded should return true")
 	}
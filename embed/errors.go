@@ -0,0 +1,197 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
+)
+
+var (
+	// ErrAlreadyRunning is returned when starting an Instance that already
+	// has a running Tor.
+	ErrAlreadyRunning = errors.New("tor instance already running")
+
+	// ErrNotRunning is returned by operations that need a running Tor.
+	ErrNotRunning = errors.New("tor instance not running")
+
+	// ErrUnexpectedExit is the Instance.Err of a Tor that exited cleanly
+	// without being stopped.
+	ErrUnexpectedExit = errors.New("tor exited unexpectedly")
+
+	// ErrBootstrapFatal is the BootstrapError.Err when Tor reports an
+	// unrecoverable bootstrap problem.
+	ErrBootstrapFatal = errors.New("tor reported a fatal bootstrap error")
+
+	// ErrUnknownOption is the ConfigError.Err of an option Tor does not
+	// know.
+	ErrUnknownOption = errors.New("unknown option")
+
+	// ErrInvalidValue is wrapped by the ConfigError.Err of a malformed
+	// option value.
+	ErrInvalidValue = errors.New("invalid value")
+
+	// ErrConflictingOptions is wrapped by the ConfigError.Err of an option
+	// that conflicts with another.
+	ErrConflictingOptions = errors.New("conflicting options")
+
+	// ErrDataDirInUse is the DataDirError.Err when another Tor holds the
+	// lock file in the data directory.
+	ErrDataDirInUse = errors.New("in use by another tor process")
+
+	// ErrSnapshotStale is wrapped by the error of CheckSnapshot and
+	// SeedDataDir for a snapshot whose consensus is not currently valid.
+	ErrSnapshotStale = errors.New("snapshot consensus is not fresh")
+
+	// ErrStateIntegrity is wrapped by the error of ImportState for an
+	// archive that is corrupted, truncated or does not match its manifest.
+	ErrStateIntegrity = errors.New("state archive failed integrity check")
+
+	// ErrKeyNotFound is wrapped by the error of KeyStore.Load when no key
+	// is stored under the name.
+	ErrKeyNotFound = errors.New("onion service key not found")
+
+	// ErrKeyDecrypt is wrapped by the error of EncryptedKeyStore.Load for a
+	// key that can't be decrypted with the passphrase.
+	ErrKeyDecrypt = errors.New("failed to decrypt onion service key")
+
+	// ErrAlreadyStarted is returned when the Tor process was already
+	// started.
+	ErrAlreadyStarted = tor048.ErrAlreadyStarted
+
+	// ErrNotStarted is returned when waiting on a Tor process that was
+	// never started.
+	ErrNotStarted = tor048.ErrNotStarted
+
+	// ErrRestartUnsupported is returned when starting the embedded Tor after
+	// it has already run in this process. Use an Instance created with
+	// NewInstanceWithCreator and a child-process creator for restarts.
+	ErrRestartUnsupported = tor048.ErrRestartUnsupported
+)
+
+// ExitError is returned when Tor exits with a non-zero code, either while
+// starting (wrapped in a *StartError) or later (as Instance.Err).
+type ExitError = tor048.ExitError
+
+// StartError is returned when Tor could not be launched or its control
+// connection could not be established. Starting again with the same
+// configuration is unlikely to help unless Exit shows a transient cause.
+type StartError struct {
+	// Err is the error reported while starting
+	Err error
+
+	// Exit is set when the Tor process had already exited, which is
+	// usually the real cause of Err
+	Exit *ExitError
+
+	// Embedded is true when Tor ran in this process, false when it ran as
+	// a tor executable, such as the system tor
+	Embedded bool
+}
+
+func (e *StartError) Error() string {
+	name := "Tor"
+	if e.Embedded {
+		name = "embedded Tor"
+	}
+	if e.Exit != nil {
+		return fmt.Sprintf("failed to start %s: %v (%v)", name, e.Err, e.Exit)
+	}
+	return fmt.Sprintf("failed to start %s: %v", name, e.Err)
+}
+
+// Unwrap returns both the start error and the exit error so errors.Is and
+// errors.As can match either.
+func (e *StartError) Unwrap() []error {
+	if e.Exit != nil {
+		return []error{e.Err, e.Exit}
+	}
+	return []error{e.Err}
+}
+
+// DataDirError is returned when the data directory cannot be created or is
+// unusable. It is a configuration problem; retrying will not help.
+type DataDirError struct {
+	// Dir is the data directory path
+	Dir string
+
+	// Err describes what is wrong with Dir
+	Err error
+}
+
+func (e *DataDirError) Error() string {
+	return fmt.Sprintf("data directory %q: %v", e.Dir, e.Err)
+}
+
+func (e *DataDirError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigError is returned when a Config holds an unknown, malformed or
+// conflicting option. It is a configuration problem; retrying will not help.
+type ConfigError struct {
+	// Option is the Tor option name, e.g. "SocksPort", or empty when the
+	// problem is not tied to one option
+	Option string
+
+	// Value is the offending value, if any
+	Value string
+
+	// Err wraps ErrUnknownOption, ErrInvalidValue or ErrConflictingOptions
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Option == "" {
+		return fmt.Sprintf("invalid configuration: %v", e.Err)
+	}
+	if e.Value != "" {
+		return fmt.Sprintf("option %s %q: %v", e.Option, e.Value, e.Err)
+	}
+	return fmt.Sprintf("option %s: %v", e.Option, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// BootstrapError is returned when bootstrapping fails or does not finish in
+// time. It names the last phase Tor reached.
+type BootstrapError struct {
+	// Phase is the tag of the last bootstrap step seen
+	Phase string
+
+	// Summary is the human-readable description of Phase
+	Summary string
+
+	// Progress is the percentage of the last bootstrap step seen
+	Progress int
+
+	// Warning is the last warning Tor reported, if any
+	Warning string
+
+	// LastLogLines are Tor's most recent notice, warning and error log
+	// lines, oldest first
+	LastLogLines []string
+
+	// Err is the underlying cause, such as context.DeadlineExceeded
+	Err error
+}
+
+func (e *BootstrapError) Error() string {
+	msg := fmt.Sprintf("failed to bootstrap Tor: stuck at %d%% (%s)", e.Progress, e.Phase)
+	if e.Summary != "" {
+		msg += ": " + e.Summary
+	}
+	if e.Warning != "" {
+		msg += ", last warning: " + e.Warning
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BootstrapError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,45 @@
+package embed
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStartErrorUnwrapsExit(t *testing.T) {
+	exitErr := &ExitError{Code: 1, LastLogLines: []string{"[err] Failed to parse/validate config"}}
+	err := error(&StartError{Err: io.EOF, Exit: exitErr})
+
+	if !errors.Is(err, io.EOF) {
+		t.Error("Expected StartError to match its start error")
+	}
+	var gotExit *ExitError
+	if !errors.As(err, &gotExit) || gotExit.Code != 1 {
+		t.Error("Expected StartError to expose its ExitError")
+	}
+}
+
+func TestStartErrorMessage(t *testing.T) {
+	embedded := &StartError{Err: io.EOF, Embedded: true}
+	if got := embedded.Error(); got != "failed to start embedded Tor: EOF" {
+		t.Errorf("Unexpected message %q", got)
+	}
+	system := &StartError{Err: io.EOF}
+	if got := system.Error(); got != "failed to start Tor: EOF" {
+		t.Errorf("Unexpected message %q", got)
+	}
+}
+
+func TestDataDirErrorFromPrepare(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var dirErr *DataDirError
+	if err := prepareDataDir(file); !errors.As(err, &dirErr) || dirErr.Dir != file {
+		t.Errorf("Expected DataDirError for %s, got %v", file, err)
+	}
+}
@@ -0,0 +1,168 @@
+package embed
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RelayAnon/tor-static-builder/embed/onion"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
+)
+
+// Files of a v3 onion service directory, as Tor names them.
+const (
+	onionKeyFile       = "hs_ed25519_secret_key"
+	onionPublicKeyFile = "hs_ed25519_public_key"
+	hostnameFile       = "hostname"
+)
+
+// Headers of Tor's key files, padded with NULs to 32 bytes.
+const (
+	torSecretKeyHeader = "== ed25519v1-secret: type0 ==\x00\x00\x00"
+	torPublicKeyHeader = "== ed25519v1-public: type0 ==\x00\x00\x00"
+)
+
+// ed25519V3Prefix starts the ADD_ONION key blob of a v3 service.
+const ed25519V3Prefix = "ED25519-V3:"
+
+// ExpandKey converts a standard ed25519.PrivateKey, as kept by a KeyStore,
+// to the expanded form Tor uses: the clamped scalar and nonce prefix
+// derived from the seed. The conversion can't be reversed, so a key
+// imported from Tor stays in the expanded form.
+func ExpandKey(key ed25519.PrivateKey) tored25519.KeyPair {
+	return tored25519.FromCryptoPrivateKey(key)
+}
+
+// MarshalTorSecretKey returns key in the format of the
+// hs_ed25519_secret_key file of a HiddenServiceDir.
+func MarshalTorSecretKey(key tored25519.KeyPair) []byte {
+	return append([]byte(torSecretKeyHeader), key.PrivateKey()...)
+}
+
+// ParseTorSecretKey parses the contents of an hs_ed25519_secret_key file.
+func ParseTorSecretKey(data []byte) (tored25519.KeyPair, error) {
+	priv, ok := bytes.CutPrefix(data, []byte(torSecretKeyHeader))
+	if !ok {
+		return nil, errors.New("not an ed25519 secret key file")
+	}
+	return parseExpandedKey(priv)
+}
+
+// MarshalTorPublicKey returns pub in the format of the
+// hs_ed25519_public_key file of a HiddenServiceDir.
+func MarshalTorPublicKey(pub tored25519.PublicKey) []byte {
+	return append([]byte(torPublicKeyHeader), pub...)
+}
+
+// ParseTorPublicKey parses the contents of an hs_ed25519_public_key file.
+func ParseTorPublicKey(data []byte) (tored25519.PublicKey, error) {
+	pub, ok := bytes.CutPrefix(data, []byte(torPublicKeyHeader))
+	if !ok {
+		return nil, errors.New("not an ed25519 public key file")
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key of %d bytes", len(pub))
+	}
+	return tored25519.PublicKey(pub), nil
+}
+
+// ED25519V3Blob returns key as the "ED25519-V3:" key blob of ADD_ONION,
+// the PrivateKey Tor returns for a generated v3 service.
+func ED25519V3Blob(key tored25519.KeyPair) string {
+	return ed25519V3Prefix + base64.StdEncoding.EncodeToString(key.PrivateKey())
+}
+
+// ParseED25519V3Blob parses an ADD_ONION key blob of a v3 service, with or
+// without its "ED25519-V3:" prefix.
+func ParseED25519V3Blob(blob string) (tored25519.KeyPair, error) {
+	if keyType, rest, ok := strings.Cut(blob, ":"); ok {
+		if keyType+":" != ed25519V3Prefix {
+			return nil, fmt.Errorf("unsupported key type %q", keyType)
+		}
+		blob = rest
+	}
+	priv, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key blob: %w", err)
+	}
+	return parseExpandedKey(priv)
+}
+
+// WriteOnionServiceDir writes key to dir as the hs_ed25519_secret_key,
+// hs_ed25519_public_key and hostname files of a HiddenServiceDir, so a
+// standalone tor, or Config.OnionServices, serves the same address. dir is
+// created with owner-only permissions as Tor requires. Existing files are
+// replaced.
+func WriteOnionServiceDir(dir string, key tored25519.KeyPair) error {
+	if _, err := parseExpandedKey(key.PrivateKey()); err != nil {
+		return err
+	}
+	id, err := onion.IDFromPublicKey(ed25519.PublicKey(key.PublicKey()))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{onionKeyFile, MarshalTorSecretKey(key)},
+		{onionPublicKeyFile, MarshalTorPublicKey(key.PublicKey())},
+		{hostnameFile, []byte(id + ".onion\n")},
+	}
+	for _, f := range files {
+		if err := writeKeyFile(dir, f.name, f.data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// ReadOnionServiceDir reads the key of the HiddenServiceDir dir, such as
+// one of a standalone tor, checking it against hs_ed25519_public_key if
+// that file exists. The key can be passed as tor.ListenConf.Key to serve
+// the same address on the embedded Tor.
+func ReadOnionServiceDir(dir string) (tored25519.KeyPair, error) {
+	data, err := os.ReadFile(filepath.Join(dir, onionKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseTorSecretKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", onionKeyFile, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, onionPublicKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pub, err := ParseTorPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", onionPublicKeyFile, err)
+	}
+	if !bytes.Equal(pub, key.PublicKey()) {
+		return nil, fmt.Errorf("%s does not match %s", onionPublicKeyFile, onionKeyFile)
+	}
+	return key, nil
+}
+
+// parseExpandedKey checks that priv is an expanded ed25519 key with a
+// clamped scalar and returns it with its public key.
+func parseExpandedKey(priv []byte) (tored25519.KeyPair, error) {
+	if len(priv) != 64 {
+		return nil, fmt.Errorf("invalid expanded ed25519 key of %d bytes", len(priv))
+	}
+	if priv[0]&7 != 0 || priv[31]&0xc0 != 0x40 {
+		return nil, errors.New("invalid expanded ed25519 key: scalar is not clamped")
+	}
+	return tored25519.PrivateKey(append([]byte(nil), priv...)).KeyPair(), nil
+}
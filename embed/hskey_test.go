@@ -0,0 +1,135 @@
+package embed
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/RelayAnon/tor-static-builder/embed/onion"
+	tored25519 "github.com/cretz/bine/torutil/ed25519"
+)
+
+func TestExpandKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ExpandKey(priv)
+	if !bytes.Equal(key.PublicKey(), pub) {
+		t.Error("Expanded key has a different public key")
+	}
+	// Signatures of the expanded key verify with the standard public key
+	msg := []byte("hello")
+	if !ed25519.Verify(pub, msg, tored25519.Sign(key, msg)) {
+		t.Error("Signature of the expanded key does not verify")
+	}
+}
+
+func TestTorKeyFiles(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	key := ExpandKey(priv)
+
+	secret := MarshalTorSecretKey(key)
+	if len(secret) != 96 || !strings.HasPrefix(string(secret), "== ed25519v1-secret: type0 ==") {
+		t.Errorf("Unexpected secret key file of %d bytes", len(secret))
+	}
+	parsed, err := ParseTorSecretKey(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.PrivateKey(), key.PrivateKey()) || !bytes.Equal(parsed.PublicKey(), key.PublicKey()) {
+		t.Error("Parsed secret key differs")
+	}
+
+	public := MarshalTorPublicKey(key.PublicKey())
+	if len(public) != 64 {
+		t.Errorf("Unexpected public key file of %d bytes", len(public))
+	}
+	pub, err := ParseTorPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub, key.PublicKey()) {
+		t.Error("Parsed public key differs")
+	}
+
+	if _, err := ParseTorSecretKey(public); err == nil {
+		t.Error("Expected an error for a public key file")
+	}
+	if _, err := ParseTorSecretKey(secret[:80]); err == nil {
+		t.Error("Expected an error for a truncated key")
+	}
+	unclamped := append([]byte(nil), secret...)
+	unclamped[32] |= 1
+	if _, err := ParseTorSecretKey(unclamped); err == nil {
+		t.Error("Expected an error for an unclamped scalar")
+	}
+}
+
+func TestED25519V3Blob(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(nil)
+	key := ExpandKey(priv)
+
+	blob := ED25519V3Blob(key)
+	if !strings.HasPrefix(blob, "ED25519-V3:") {
+		t.Errorf("Unexpected blob %q", blob)
+	}
+	for _, b := range []string{blob, strings.TrimPrefix(blob, "ED25519-V3:")} {
+		parsed, err := ParseED25519V3Blob(b)
+		if err != nil {
+			t.Fatalf("ParseED25519V3Blob(%q): %v", b, err)
+		}
+		if !bytes.Equal(parsed.PrivateKey(), key.PrivateKey()) {
+			t.Error("Parsed blob differs")
+		}
+	}
+	if _, err := ParseED25519V3Blob("RSA1024:AAAA"); err == nil {
+		t.Error("Expected an error for an RSA blob")
+	}
+}
+
+func TestOnionServiceDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hs")
+	_, priv, _ := ed25519.GenerateKey(nil)
+	key := ExpandKey(priv)
+	if err := WriteOnionServiceDir(dir, key); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("Service directory mode %o is accessible by others", info.Mode().Perm())
+	}
+	hostname, err := os.ReadFile(filepath.Join(dir, "hostname"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := onion.IDFromPublicKey(ed25519.PublicKey(key.PublicKey()))
+	if want := id + ".onion\n"; string(hostname) != want {
+		t.Errorf("hostname = %q, want %q", hostname, want)
+	}
+
+	read, err := ReadOnionServiceDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read.PrivateKey(), key.PrivateKey()) {
+		t.Error("Read key differs")
+	}
+
+	// A public key file of another key is an error
+	_, other, _ := ed25519.GenerateKey(nil)
+	if err := os.WriteFile(filepath.Join(dir, "hs_ed25519_public_key"),
+		MarshalTorPublicKey(ExpandKey(other).PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOnionServiceDir(dir); err == nil {
+		t.Error("Expected an error for a mismatched public key")
+	}
+}
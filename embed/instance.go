@@ -0,0 +1,278 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
+	"github.com/cretz/bine/process"
+	"github.com/cretz/bine/tor"
+)
+
+// Instance is a single embedded Tor instance. It owns the running *tor.Tor,
+// its data directory and the onion services registered with it, so several
+// components can each hold their own Instance instead of sharing package
+// state. Create instances with NewInstance or NewInstanceWithCreator.
+//
+// The in-process Tor can run only once per process: after it has been
+// stopped, or while another Instance runs it, starting an embedded Instance
+// returns ErrRestartUnsupported. Applications that need to restart Tor
+// should run it as a child process with NewInstanceWithCreator.
+type Instance struct {
+	creator process.Creator
+
+	// embedded is true when creator runs Tor in this process and provides
+	// the embedded control connection
+	embedded bool
+
+	// mu serializes Start and Stop
+	mu sync.Mutex
+
+	// tenants are the listeners added by AddSocksListener, guarded by mu
+	tenants []*SocksListener
+
+	// tor holds the running Tor, nil when stopped
+	tor atomic.Pointer[tor.Tor]
+
+	// listeners holds the listeners reported after Start
+	listeners atomic.Pointer[Listeners]
+
+	// applied holds the configuration given to Start or Apply
+	applied atomic.Pointer[appliedConfig]
+
+	// ephemeralDir holds the data directory to remove on stop, if any
+	ephemeralDir atomic.Pointer[string]
+
+	// onions is the registry of onion services
+	onions onionRegistry
+
+	// logs holds the recent log lines of the current or last run
+	logs atomic.Pointer[logRing]
+
+	// life tracks the lifecycle state and its subscribers
+	life lifecycle
+}
+
+// NewInstance creates an Instance backed by the embedded Tor process creator,
+// or by the system tor executable when Tor is not embedded. Tor is not
+// started until Start, StartTor or StartTorWithBootstrap is called.
+func NewInstance() *Instance {
+	return &Instance{creator: GetProcessCreator(), embedded: IsEmbedded()}
+}
+
+// NewInstanceWithCreator creates an Instance that runs Tor as a separate
+// process using creator, such as bine's process.NewCreator for a tor
+// executable. The control connection is made over a TCP control port.
+// Unlike the in-process Tor, such an instance can be stopped and started
+// again.
+func NewInstanceWithCreator(creator process.Creator) *Instance {
+	return &Instance{creator: creator}
+}
+
+// StartTor starts Tor for this instance with the given data directory and
+// extra command-line arguments. It returns ErrAlreadyRunning if the instance
+// already has a running Tor, ErrRestartUnsupported if the in-process Tor
+// has already run and a *DataDirError wrapping ErrDataDirInUse if another
+// Tor is using dataDir.
+func (i *Instance) StartTor(ctx context.Context, dataDir string, extraArgs ...string) (*tor.Tor, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.startLocked(ctx, dataDir, extraArgs, logOptions{})
+}
+
+// StartTorWithBootstrap starts Tor for this instance and waits for it to
+// bootstrap. If bootstrapping fails, the instance is stopped again.
+func (i *Instance) StartTorWithBootstrap(ctx context.Context, dataDir string, timeout time.Duration) (*tor.Tor, error) {
+	return i.StartTorWithProgress(ctx, dataDir, timeout, nil)
+}
+
+// checkStartLocked returns ErrAlreadyRunning or ErrRestartUnsupported if
+// Tor can't be started now, and releases a Tor that exited on its own.
+func (i *Instance) checkStartLocked() error {
+	if i.tor.Load() != nil {
+		if i.State() != StateFailed {
+			return ErrAlreadyRunning
+		}
+		// Tor exited on its own; release what is left of it first
+		i.stopLocked()
+	}
+	if i.embedded && tor048.HasRun() {
+		return ErrRestartUnsupported
+	}
+	return nil
+}
+
+func (i *Instance) startLocked(ctx context.Context, dataDir string, extraArgs []string, logs logOptions) (*tor.Tor, error) {
+	if err := i.checkStartLocked(); err != nil {
+		return nil, err
+	}
+	if dataDir != "" {
+		if err := checkDataDirLock(dataDir); err != nil {
+			return nil, err
+		}
+	}
+	i.setState(StateStarting, "start requested", nil)
+
+	ring := newLogRing(logRingSize)
+	i.logs.Store(ring)
+
+	// Configure Tor start options
+	creator := &watchedCreator{Creator: i.creator}
+	startConf := &tor.StartConf{
+		ProcessCreator:         creator,
+		UseEmbeddedControlConn: i.embedded,
+		DataDir:                dataDir,
+		NoAutoSocksPort:        true,
+		NoHush:                 logs.logger != nil,
+		ExtraArgs:              append(logs.args(), extraArgs...),
+	}
+
+	// Start Tor
+	t, err := tor.Start(ctx, startConf)
+	if err != nil {
+		startErr := &StartError{Err: err, Exit: withLogLines(creator.last.exitError(), ring), Embedded: i.embedded}
+		i.setState(StateFailed, "start failed", startErr)
+		return nil, startErr
+	}
+
+	// Store the instance. Log events are only available once the control
+	// connection is up; earlier output goes to the console.
+	i.tor.Store(t)
+	if err := forwardLogs(t, ring, logs); err != nil {
+		// With a Logger, Tor's console output is off, so its logs would
+		// go nowhere
+		startErr := &StartError{Err: fmt.Errorf("failed to subscribe to log events: %w", err), Embedded: i.embedded}
+		i.shutdownLocked(startErr)
+		return nil, startErr
+	}
+	i.setState(StateControlReady, "control connection ready", nil)
+	i.watch(t)
+	return t, nil
+}
+
+// bootstrapLocked enables the network on t and waits for bootstrap. On
+// failure Tor is stopped and the instance is left in StateFailed.
+func (i *Instance) bootstrapLocked(ctx context.Context, t *tor.Tor, progress BootstrapFunc) error {
+	bootstrapping := transition{from: []State{StateControlReady}}
+	i.setStateFor(t, bootstrapping.allowed, StateBootstrapping, "enabling network", nil)
+
+	if err := WaitBootstrap(ctx, t, progress); err != nil {
+		// If Tor died while bootstrapping, its exit is the real cause
+		var bootErr *BootstrapError
+		if errors.As(err, &bootErr) {
+			ring := i.logs.Load()
+			bootErr.LastLogLines = ring.snapshot()
+			if p, ok := t.Process.(*watchedProcess); ok {
+				if exitErr := p.exitError(); exitErr != nil {
+					bootErr.Err = withLogLines(exitErr, ring)
+				}
+			}
+		}
+		i.shutdownLocked(err)
+		return err
+	}
+
+	ready := transition{from: []State{StateControlReady, StateBootstrapping}}
+	i.setStateFor(t, ready.allowed, StateReady, "bootstrap complete", nil)
+	return nil
+}
+
+// Tor returns the running Tor, or nil if the instance is not running.
+func (i *Instance) Tor() *tor.Tor {
+	return i.tor.Load()
+}
+
+// DataDir returns the data directory of the running Tor, or an empty string
+// if the instance is not running.
+func (i *Instance) DataDir() string {
+	t := i.tor.Load()
+	if t == nil {
+		return ""
+	}
+	return t.DataDir
+}
+
+// Stop gracefully shuts down Tor if this instance is running. Stopping an
+// instance that is not running is a no-op.
+func (i *Instance) Stop() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.stopLocked()
+}
+
+// Kill stops Tor without waiting for a clean shutdown. A child process is
+// killed outright; the in-process Tor is halted. Errors from closing the
+// control connection of a killed Tor are expected and not reported.
+func (i *Instance) Kill() {
+	// Kill or cancel before taking the lock so a Start blocked in bootstrap
+	// fails fast instead of holding it. Cancelling alone would give a child
+	// process time to exit cleanly.
+	if t := i.tor.Load(); t != nil {
+		if p, ok := t.Process.(*watchedProcess); ok {
+			p.kill()
+		}
+		if t.ProcessCancelFunc != nil {
+			t.ProcessCancelFunc()
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.stopLocked()
+}
+
+func (i *Instance) stopLocked() error {
+	return i.shutdownLocked(nil)
+}
+
+// shutdownLocked stops Tor and clears the instance. With a nil cause the
+// instance ends in StateStopped, otherwise in StateFailed with that cause.
+func (i *Instance) shutdownLocked(cause error) error {
+	t := i.tor.Load()
+	if t == nil {
+		return nil
+	}
+	i.setState(StateStopping, "stopping", nil)
+
+	// Clear the instance first so a failed close does not leave a closed Tor
+	// behind
+	i.tor.Store(nil)
+	i.listeners.Store(nil)
+	i.applied.Store(nil)
+	i.tenants = nil
+	i.onions.clear()
+	p, watched := t.Process.(*watchedProcess)
+	err := t.Close()
+
+	// Close only waits briefly for the process. Make sure Tor has really
+	// exited, cancelling its context to force a shutdown if the halt did
+	// not get through.
+	if watched {
+		select {
+		case <-p.done:
+		default:
+			if t.ProcessCancelFunc != nil {
+				t.ProcessCancelFunc()
+			}
+			<-p.done
+		}
+	}
+	if dir := i.ephemeralDir.Swap(nil); dir != nil {
+		os.RemoveAll(*dir)
+	}
+
+	if cause != nil {
+		i.setState(StateFailed, "startup failed", cause)
+	} else {
+		i.setState(StateStopped, "stopped", nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stop Tor: %w", err)
+	}
+	return nil
+}
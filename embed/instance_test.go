@@ -0,0 +1,52 @@
+package embed
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewInstanceNotRunning(t *testing.T) {
+	inst := NewInstance()
+	if inst.Tor() != nil {
+		t.Error("Expected nil Tor for a new instance")
+	}
+	if inst.DataDir() != "" {
+		t.Errorf("Expected empty data dir, got %q", inst.DataDir())
+	}
+
+	if _, err := inst.QueryListeners(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning from QueryListeners, got %v", err)
+	}
+
+	// Stopping an instance that never started should be a no-op
+	if err := inst.Stop(); err != nil {
+		t.Errorf("Stop on idle instance should not error: %v", err)
+	}
+}
+
+func TestInstancesAreIndependent(t *testing.T) {
+	a := NewInstance()
+	b := NewInstance()
+
+	a.SetOnionAddress("a.onion")
+	if b.OnionAddress() != "" {
+		t.Errorf("Instance b saw address from instance a: %q", b.OnionAddress())
+	}
+	if a.OnionAddress() != "a.onion" {
+		t.Errorf("Got %s, want a.onion", a.OnionAddress())
+	}
+
+	// The package-level address belongs to the default instance only
+	if GetOnionAddress() != "" {
+		t.Errorf("Default instance saw address from instance a: %q", GetOnionAddress())
+	}
+}
+
+func TestDefaultInstanceBacksFreeFunctions(t *testing.T) {
+	SetOnionAddress("default.onion")
+	defer SetOnionAddress("")
+
+	if Default().OnionAddress() != "default.onion" {
+		t.Errorf("Got %s, want default.onion", Default().OnionAddress())
+	}
+}
@@ -0,0 +1,37 @@
+// Package torconf parses torrc values shared by the embed package and the
+// Tor process creator.
+package torconf
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intervalUnits are the units Tor accepts for a time interval. A month is
+// Tor's 30.4368 days.
+var intervalUnits = map[string]time.Duration{
+	"":    time.Second,
+	"sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"hour": time.Hour, "hours": time.Hour,
+	"day": 24 * time.Hour, "days": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	"month": 2629728 * time.Second, "months": 2629728 * time.Second,
+}
+
+// ParseInterval parses a torrc time interval such as "30", "30 seconds",
+// "2minutes" or "1 month". A number without a unit is in seconds.
+func ParseInterval(val string) (time.Duration, bool) {
+	val = strings.TrimSpace(val)
+	digits := len(val) - len(strings.TrimLeft(val, "0123456789"))
+	n, err := strconv.ParseInt(val[:digits], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	unit, ok := intervalUnits[strings.ToLower(strings.TrimSpace(val[digits:]))]
+	if !ok || n > int64(1<<63-1)/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
@@ -0,0 +1,38 @@
+package torconf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		val  string
+		want time.Duration
+		ok   bool
+	}{
+		{"30", 30 * time.Second, true},
+		{"10 seconds", 10 * time.Second, true},
+		{"10seconds", 10 * time.Second, true},
+		{"1 sec", time.Second, true},
+		{"2 Minutes", 2 * time.Minute, true},
+		{"1 hour", time.Hour, true},
+		{"3 days", 72 * time.Hour, true},
+		{"2 weeks", 14 * 24 * time.Hour, true},
+		{"1 month", 2629728 * time.Second, true},
+		{"2months", 2 * 2629728 * time.Second, true},
+		{"", 0, false},
+		{"seconds", 0, false},
+		{"-5", 0, false},
+		{"1.5 hours", 0, false},
+		{"10 secs", 0, false},
+		{"5 fortnights", 0, false},
+		{"99999999999999 weeks", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseInterval(tt.val)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseInterval(%q) = %v, %v, want %v, %v", tt.val, got, ok, tt.want, tt.ok)
+		}
+	}
+}
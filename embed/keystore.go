@@ -0,0 +1,281 @@
+package embed
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyStore stores the private keys of persistent onion services by name,
+// so a service keeps its address across restarts. Implementations must be
+// safe for concurrent use.
+type KeyStore interface {
+	// Load returns the key stored under name, or an error wrapping
+	// ErrKeyNotFound if there is none
+	Load(name string) (ed25519.PrivateKey, error)
+
+	// Save stores key under name, replacing any key stored before
+	Save(name string, key ed25519.PrivateKey) error
+
+	// Delete removes the key stored under name. Deleting a missing key is
+	// not an error.
+	Delete(name string) error
+}
+
+// onionKeysDir is the directory under the data directory where
+// ListenPersistent keeps keys when Config.KeyStore is not set.
+const onionKeysDir = "onion_keys"
+
+// FileKeyStore stores each key unencrypted in a file named after it in a
+// directory, as the 64 bytes of an ed25519.PrivateKey. Files are readable
+// by the owner only.
+type FileKeyStore struct {
+	dir string
+}
+
+// NewFileKeyStore returns a KeyStore keeping keys in dir, which is created
+// when the first key is saved.
+func NewFileKeyStore(dir string) *FileKeyStore {
+	return &FileKeyStore{dir: dir}
+}
+
+// Load implements KeyStore.
+func (s *FileKeyStore) Load(name string) (ed25519.PrivateKey, error) {
+	data, err := readKeyFile(s.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(name, data)
+}
+
+// Save implements KeyStore.
+func (s *FileKeyStore) Save(name string, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid ed25519 private key of %d bytes", len(key))
+	}
+	return writeKeyFile(s.dir, name, key)
+}
+
+// Delete implements KeyStore.
+func (s *FileKeyStore) Delete(name string) error {
+	return deleteKeyFile(s.dir, name)
+}
+
+// EncryptedKeyStore stores each key in a file named after it in a
+// directory, encrypted with AES-256-GCM under a key derived from a
+// passphrase with scrypt. Files are readable by the owner only.
+type EncryptedKeyStore struct {
+	dir        string
+	passphrase []byte
+}
+
+// Parameters of the encrypted key files. The magic is authenticated along
+// with the key, so a file of another format or version fails to decrypt.
+const (
+	encryptedKeyMagic = "embed-ed25519-scrypt-v1\n"
+	scryptN           = 1 << 15
+	scryptR           = 8
+	scryptP           = 1
+	scryptSaltSize    = 16
+)
+
+// NewEncryptedKeyStore returns a KeyStore keeping keys in dir encrypted
+// with passphrase. Loading a key saved with another passphrase fails with
+// an error wrapping ErrKeyDecrypt.
+func NewEncryptedKeyStore(dir string, passphrase []byte) *EncryptedKeyStore {
+	return &EncryptedKeyStore{dir: dir, passphrase: append([]byte(nil), passphrase...)}
+}
+
+// Load implements KeyStore.
+func (s *EncryptedKeyStore) Load(name string) (ed25519.PrivateKey, error) {
+	data, err := readKeyFile(s.dir, name)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := bytes.CutPrefix(data, []byte(encryptedKeyMagic))
+	if !ok || len(rest) < scryptSaltSize {
+		return nil, fmt.Errorf("%w: %s is not an encrypted key", ErrKeyDecrypt, name)
+	}
+	aead, err := s.cipher(rest[:scryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[scryptSaltSize:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrKeyDecrypt, name)
+	}
+	plain, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(encryptedKeyMagic))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: wrong passphrase or corrupted file", ErrKeyDecrypt, name)
+	}
+	return parsePrivateKey(name, plain)
+}
+
+// Save implements KeyStore.
+func (s *EncryptedKeyStore) Save(name string, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid ed25519 private key of %d bytes", len(key))
+	}
+	salt := make([]byte, scryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := append([]byte(encryptedKeyMagic), salt...)
+	data = append(data, nonce...)
+	data = aead.Seal(data, nonce, key, []byte(encryptedKeyMagic))
+	return writeKeyFile(s.dir, name, data)
+}
+
+// Delete implements KeyStore.
+func (s *EncryptedKeyStore) Delete(name string) error {
+	return deleteKeyFile(s.dir, name)
+}
+
+// cipher derives the file key for salt from the passphrase.
+func (s *EncryptedKeyStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// MemoryKeyStore keeps keys in memory only, for tests and for services that
+// should live only as long as the process.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]ed25519.PrivateKey
+}
+
+// NewMemoryKeyStore returns an empty MemoryKeyStore.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: map[string]ed25519.PrivateKey{}}
+}
+
+// Load implements KeyStore.
+func (s *MemoryKeyStore) Load(name string) (ed25519.PrivateKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, name)
+	}
+	return append(ed25519.PrivateKey(nil), key...), nil
+}
+
+// Save implements KeyStore.
+func (s *MemoryKeyStore) Save(name string, key ed25519.PrivateKey) error {
+	if len(key) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid ed25519 private key of %d bytes", len(key))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = map[string]ed25519.PrivateKey{}
+	}
+	s.keys[name] = append(ed25519.PrivateKey(nil), key...)
+	return nil
+}
+
+// Delete implements KeyStore.
+func (s *MemoryKeyStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, name)
+	return nil
+}
+
+// checkKeyName rejects names that are not a plain file name. Names starting
+// with a dot are reserved for temporary files.
+func checkKeyName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid key name %q", name)
+	}
+	return nil
+}
+
+// parsePrivateKey checks that data is an ed25519.PrivateKey whose public
+// half matches its seed.
+func parsePrivateKey(name string, data []byte) (ed25519.PrivateKey, error) {
+	if len(data) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("key %s is not an ed25519 private key", name)
+	}
+	key := ed25519.NewKeyFromSeed(data[:ed25519.SeedSize])
+	if !bytes.Equal(key, data) {
+		return nil, fmt.Errorf("key %s does not match its public key", name)
+	}
+	return key, nil
+}
+
+func readKeyFile(dir, name string) ([]byte, error) {
+	if err := checkKeyName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, name)
+	}
+	return data, err
+}
+
+// writeKeyFile replaces the file of name in dir atomically, so a crash
+// never leaves a truncated key behind.
+func writeKeyFile(dir, name string, data []byte) error {
+	if err := checkKeyName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
+
+func deleteKeyFile(dir, name string) error {
+	if err := checkKeyName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
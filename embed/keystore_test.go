@@ -0,0 +1,155 @@
+package embed
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/bine/tor"
+)
+
+func TestKeyStores(t *testing.T) {
+	stores := map[string]KeyStore{
+		"file":      NewFileKeyStore(filepath.Join(t.TempDir(), "keys")),
+		"encrypted": NewEncryptedKeyStore(filepath.Join(t.TempDir(), "keys"), []byte("secret")),
+		"memory":    NewMemoryKeyStore(),
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, store := range stores {
+		if _, err := store.Load("web"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s: expected ErrKeyNotFound, got %v", kind, err)
+		}
+		if err := store.Save("web", key); err != nil {
+			t.Fatalf("%s: Save failed: %v", kind, err)
+		}
+		got, err := store.Load("web")
+		if err != nil {
+			t.Fatalf("%s: Load failed: %v", kind, err)
+		}
+		if !bytes.Equal(got, key) {
+			t.Errorf("%s: loaded key differs from the saved one", kind)
+		}
+		if err := store.Delete("web"); err != nil {
+			t.Errorf("%s: Delete failed: %v", kind, err)
+		}
+		if err := store.Delete("web"); err != nil {
+			t.Errorf("%s: deleting a missing key should succeed, got %v", kind, err)
+		}
+		if _, err := store.Load("web"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("%s: expected ErrKeyNotFound after Delete, got %v", kind, err)
+		}
+		if err := store.Save("web", key[:32]); err == nil {
+			t.Errorf("%s: expected an error for a truncated key", kind)
+		}
+	}
+}
+
+func TestFileKeyStoreFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+	store := NewFileKeyStore(dir)
+	_, key, _ := ed25519.GenerateKey(nil)
+	if err := store.Save("web", key); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		t.Errorf("Key file mode %o is accessible by others", mode)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the key file, got %d entries", len(entries))
+	}
+
+	for _, name := range []string{"", "../web", `a\b`, ".hidden"} {
+		if err := store.Save(name, key); err == nil {
+			t.Errorf("Expected an error for key name %q", name)
+		}
+	}
+
+	// A key whose public half does not match is rejected
+	bad := append(ed25519.PrivateKey(nil), key...)
+	bad[40] ^= 1
+	if err := os.WriteFile(filepath.Join(dir, "bad"), bad, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load("bad"); err == nil {
+		t.Error("Expected an error for a mismatched key")
+	}
+}
+
+func TestEncryptedKeyStorePassphrase(t *testing.T) {
+	dir := t.TempDir()
+	_, key, _ := ed25519.GenerateKey(nil)
+	if err := NewEncryptedKeyStore(dir, []byte("right")).Save("web", key); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, key.Seed()) {
+		t.Error("Key file contains the unencrypted seed")
+	}
+
+	if _, err := NewEncryptedKeyStore(dir, []byte("wrong")).Load("web"); !errors.Is(err, ErrKeyDecrypt) {
+		t.Errorf("Expected ErrKeyDecrypt for the wrong passphrase, got %v", err)
+	}
+
+	// An unencrypted key is not mistaken for an encrypted one
+	if err := NewFileKeyStore(dir).Save("plain", key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncryptedKeyStore(dir, []byte("right")).Load("plain"); !errors.Is(err, ErrKeyDecrypt) {
+		t.Errorf("Expected ErrKeyDecrypt for an unencrypted key, got %v", err)
+	}
+}
+
+func TestListenPersistentChecks(t *testing.T) {
+	_, err := NewInstance().ListenPersistent(context.Background(), "web", &tor.ListenConf{Version3: true})
+	if !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+
+	// A name backing a live service is not loaded again
+	store := NewMemoryKeyStore()
+	inst := NewInstance()
+	inst.tor.Store(&tor.Tor{})
+	inst.applied.Store(newAppliedConfig(&Config{KeyStore: store}))
+	inst.onions.add(&OnionService{ID: testOnionID, KeySource: KeyStored, KeyName: "web"})
+	if _, err := inst.ListenPersistent(context.Background(), "web", nil); err == nil {
+		t.Error("Expected an error for a name in use")
+	}
+	if _, err := store.Load("web"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected no key to be generated, got %v", err)
+	}
+}
+
+func TestReserveKeyName(t *testing.T) {
+	var r onionRegistry
+	if !r.reserveKeyName("web") {
+		t.Fatal("Expected to reserve a free name")
+	}
+	if r.reserveKeyName("web") {
+		t.Error("Expected a reserved name to be refused")
+	}
+	if !r.reserveKeyName("api") {
+		t.Error("Expected another name to be free")
+	}
+	r.releaseKeyName("web")
+	if !r.reserveKeyName("web") {
+		t.Error("Expected a released name to be free")
+	}
+}
@@ -0,0 +1,135 @@
+package embed
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+// logRingSize is the number of recent Tor log lines kept per instance
+const logRingSize = 50
+
+// torLogLevels maps Tor's log severities to slog levels. Tor logs at notice
+// by default, so notice maps to Info and the chattier info and debug
+// severities sit below slog's Info.
+var torLogLevels = map[control.EventCode]slog.Level{
+	control.EventCodeLogDebug:  slog.LevelDebug - 4,
+	control.EventCodeLogInfo:   slog.LevelDebug,
+	control.EventCodeLogNotice: slog.LevelInfo,
+	control.EventCodeLogWarn:   slog.LevelWarn,
+	control.EventCodeLogErr:    slog.LevelError,
+}
+
+// logRing is a bounded buffer of the most recent log lines.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+func (r *logRing) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the buffered lines, oldest first.
+func (r *logRing) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.lines[:r.next]...)
+	}
+	return append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+}
+
+// logOptions selects where a start forwards Tor's log
+type logOptions struct {
+	logger *slog.Logger
+	level  slog.Level
+}
+
+// args returns the Tor arguments for o. With a logger Tor's console output
+// is silenced since everything it would print is forwarded instead.
+func (o logOptions) args() []string {
+	if o.logger == nil {
+		return nil
+	}
+	return []string{"--quiet"}
+}
+
+// RecentLogs returns Tor's most recent notice, warning and error log lines
+// from the current or last run of the instance, oldest first.
+func (i *Instance) RecentLogs() []string {
+	ring := i.logs.Load()
+	if ring == nil {
+		return nil
+	}
+	return ring.snapshot()
+}
+
+// forwardLogs subscribes to t's log events, keeping notice and higher in
+// ring and forwarding everything at or above opts.level to opts.logger if
+// it is set.
+func forwardLogs(t *tor.Tor, ring *logRing, opts logOptions) error {
+	logger, level := opts.logger, opts.level
+	var codes []control.EventCode
+	for code, l := range torLogLevels {
+		if l >= slog.LevelInfo || (logger != nil && l >= level) {
+			codes = append(codes, code)
+		}
+	}
+
+	// The listener lives until the control connection closes; see watch
+	eventCh := make(chan control.Event, 256)
+	if err := t.Control.AddEventListener(eventCh, codes...); err != nil {
+		return err
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- t.Control.HandleEvents(context.Background()) }()
+	go func() {
+		for {
+			select {
+			case <-errCh:
+				return
+			case evt := <-eventCh:
+				logEvt, _ := evt.(*control.LogEvent)
+				if logEvt == nil {
+					continue
+				}
+				l := torLogLevels[logEvt.Severity]
+				msg := strings.TrimSpace(logEvt.Raw)
+				if l >= slog.LevelInfo {
+					ring.add("[" + strings.ToLower(string(logEvt.Severity)) + "] " + msg)
+				}
+				if logger != nil && l >= level {
+					logger.Log(context.Background(), l, msg,
+						slog.String("tor_severity", strings.ToLower(string(logEvt.Severity))))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// withLogLines returns a copy of exitErr with the lines buffered in ring
+// attached. The original is shared with the process and never modified.
+func withLogLines(exitErr *ExitError, ring *logRing) *ExitError {
+	if exitErr == nil || ring == nil || len(exitErr.LastLogLines) > 0 {
+		return exitErr
+	}
+	return &ExitError{Code: exitErr.Code, LastLogLines: ring.snapshot()}
+}
@@ -0,0 +1,47 @@
+package embed
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+)
+
+func TestLogRingKeepsMostRecent(t *testing.T) {
+	ring := newLogRing(3)
+	if lines := ring.snapshot(); len(lines) != 0 {
+		t.Errorf("Expected empty ring, got %v", lines)
+	}
+
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		ring.add(line)
+	}
+	if lines := ring.snapshot(); !reflect.DeepEqual(lines, []string{"c", "d", "e"}) {
+		t.Errorf("Expected [c d e], got %v", lines)
+	}
+}
+
+func TestWithLogLinesCopiesExitError(t *testing.T) {
+	ring := newLogRing(logRingSize)
+	ring.add("[err] Could not bind to 127.0.0.1:9050: Address already in use")
+
+	exitErr := &ExitError{Code: 1}
+	got := withLogLines(exitErr, ring)
+	if got == exitErr || len(exitErr.LastLogLines) != 0 {
+		t.Error("Expected the original ExitError to be left untouched")
+	}
+	if got.Code != 1 || len(got.LastLogLines) != 1 {
+		t.Errorf("Expected code 1 with one log line, got %+v", got)
+	}
+	if withLogLines(nil, ring) != nil {
+		t.Error("Expected nil for a nil ExitError")
+	}
+}
+
+func TestLogOptionsSilenceConsole(t *testing.T) {
+	if args := (logOptions{}).args(); len(args) != 0 {
+		t.Errorf("Expected no args without a logger, got %v", args)
+	}
+	if args := (logOptions{logger: slog.Default()}).args(); !reflect.DeepEqual(args, []string{"--quiet"}) {
+		t.Errorf("Expected --quiet with a logger, got %v", args)
+	}
+}
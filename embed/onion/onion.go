@@ -0,0 +1,237 @@
+// Package onion handles v3 onion service addresses without a running Tor:
+// it derives addresses from ed25519 public keys, validates and parses
+// them, and computes the time periods and blinded keys under which
+// service descriptors are published.
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/sha3"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/edwards25519"
+)
+
+const (
+	// Version is the onion service version handled by this package
+	Version = 3
+
+	// IDLength is the length of a v3 service ID, the address without
+	// ".onion"
+	IDLength = 56
+
+	// DefaultPeriodLength is the length of a time period unless the
+	// consensus sets hsdir-interval
+	DefaultPeriodLength = 24 * time.Hour
+
+	// rotationOffset shifts time periods so they start at 12:00 UTC
+	rotationOffset = 12 * time.Hour
+
+	checksumPrefix = ".onion checksum"
+	blindString    = "Derive temporary signing key\x00"
+
+	// basepoint is the ed25519 base point as Tor hashes it into blinding
+	// factors
+	basepoint = "(15112221349535400772501151409588531511454012693041857206046113283949847762202, " +
+		"46316835694926478169428394003475163141307993866256225615783033603165251855960)"
+)
+
+var (
+	// ErrInvalidLength is returned for a service ID that is not IDLength
+	// characters long.
+	ErrInvalidLength = errors.New("invalid onion service ID length")
+
+	// ErrInvalidEncoding is returned for a service ID that is not base32.
+	ErrInvalidEncoding = errors.New("invalid onion service ID encoding")
+
+	// ErrInvalidVersion is returned for a service ID of a version other
+	// than 3.
+	ErrInvalidVersion = errors.New("unsupported onion service version")
+
+	// ErrInvalidChecksum is returned for a service ID whose checksum does
+	// not match its key, such as a mistyped address.
+	ErrInvalidChecksum = errors.New("invalid onion service ID checksum")
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// IDFromPublicKey returns the service ID of the v3 onion service with the
+// given public key: base32 of the key, a checksum and the version.
+func IDFromPublicKey(pub ed25519.PublicKey) (string, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid ed25519 public key of %d bytes", len(pub))
+	}
+	raw := make([]byte, 0, ed25519.PublicKeySize+3)
+	raw = append(raw, pub...)
+	raw = append(raw, checksum(pub)...)
+	raw = append(raw, Version)
+	return strings.ToLower(encoding.EncodeToString(raw)), nil
+}
+
+// PublicKey returns the public key of the service ID id, with or without
+// ".onion", after checking its length, encoding, version and checksum.
+func PublicKey(id string) (ed25519.PublicKey, error) {
+	id = strings.TrimSuffix(id, ".onion")
+	if len(id) != IDLength {
+		return nil, ErrInvalidLength
+	}
+	raw, err := encoding.DecodeString(strings.ToUpper(id))
+	if err != nil {
+		return nil, ErrInvalidEncoding
+	}
+	pub := ed25519.PublicKey(raw[:ed25519.PublicKeySize])
+	if raw[len(raw)-1] != Version {
+		return nil, ErrInvalidVersion
+	}
+	if sum := raw[ed25519.PublicKeySize : ed25519.PublicKeySize+2]; string(sum) != string(checksum(pub)) {
+		return nil, ErrInvalidChecksum
+	}
+	return pub, nil
+}
+
+// ValidateID checks that id, with or without ".onion", is a well-formed v3
+// service ID. The error is one of ErrInvalidLength, ErrInvalidEncoding,
+// ErrInvalidVersion and ErrInvalidChecksum.
+func ValidateID(id string) error {
+	_, err := PublicKey(id)
+	return err
+}
+
+// checksum returns the two checksum bytes of a v3 service ID.
+func checksum(pub ed25519.PublicKey) []byte {
+	h := sha3.New256()
+	h.Write([]byte(checksumPrefix))
+	h.Write(pub)
+	h.Write([]byte{Version})
+	return h.Sum(nil)[:2]
+}
+
+// Address is a parsed onion address such as "www.<id>.onion:443".
+type Address struct {
+	// Subdomain is the part before the service ID, such as "www" or
+	// "a.b", or empty. Tor ignores it when connecting.
+	Subdomain string
+
+	// ID is the lower-case service ID
+	ID string
+
+	// Port is the port, or 0 if the address has none
+	Port int
+}
+
+// ParseAddress parses an onion address: a service ID, optionally preceded
+// by subdomains and followed by ".onion" and a port. The ".onion" suffix
+// is required with subdomains. The service ID is validated as by
+// ValidateID.
+func ParseAddress(s string) (*Address, error) {
+	host, port := s, 0
+	if i := strings.LastIndexByte(s, ':'); i >= 0 {
+		var err error
+		host = s[:i]
+		if port, err = strconv.Atoi(s[i+1:]); err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port in onion address %q", s)
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	name, hasSuffix := strings.CutSuffix(host, ".onion")
+
+	addr := &Address{ID: name, Port: port}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		if !hasSuffix {
+			return nil, fmt.Errorf("onion address %q does not end in .onion", s)
+		}
+		addr.Subdomain, addr.ID = name[:i], name[i+1:]
+		for _, label := range strings.Split(addr.Subdomain, ".") {
+			if label == "" {
+				return nil, fmt.Errorf("empty label in onion address %q", s)
+			}
+		}
+	}
+	if err := ValidateID(addr.ID); err != nil {
+		return nil, fmt.Errorf("onion address %q: %w", s, err)
+	}
+	return addr, nil
+}
+
+// Host returns the address without its port, e.g. "www.<id>.onion".
+func (a *Address) Host() string {
+	if a.Subdomain == "" {
+		return a.ID + ".onion"
+	}
+	return a.Subdomain + "." + a.ID + ".onion"
+}
+
+// String returns the address with its port, if any.
+func (a *Address) String() string {
+	if a.Port == 0 {
+		return a.Host()
+	}
+	return a.Host() + ":" + strconv.Itoa(a.Port)
+}
+
+// PublicKey returns the public key of the service.
+func (a *Address) PublicKey() ed25519.PublicKey {
+	pub, _ := PublicKey(a.ID)
+	return pub
+}
+
+// TimePeriod returns the number of the time period t falls in. Periods of
+// the given length, or DefaultPeriodLength if zero, are counted from the
+// Unix epoch and start at 12:00 UTC.
+func TimePeriod(t time.Time, length time.Duration) int64 {
+	if length <= 0 {
+		length = DefaultPeriodLength
+	}
+	minutes := t.Unix()/60 - int64(rotationOffset/time.Minute)
+	return minutes / int64(length/time.Minute)
+}
+
+// TimePeriodStart returns when the time period with the given number and
+// length begins.
+func TimePeriodStart(period int64, length time.Duration) time.Time {
+	if length <= 0 {
+		length = DefaultPeriodLength
+	}
+	minutes := period*int64(length/time.Minute) + int64(rotationOffset/time.Minute)
+	return time.Unix(minutes*60, 0).UTC()
+}
+
+// BlindPublicKey returns the blinded public key of the service with public
+// key pub for a time period, as in TimePeriod. Descriptors of the period
+// are signed with, and looked up by, the blinded key.
+func BlindPublicKey(pub ed25519.PublicKey, period int64, length time.Duration) (ed25519.PublicKey, error) {
+	if length <= 0 {
+		length = DefaultPeriodLength
+	}
+	point, err := new(edwards25519.Point).SetBytes(pub)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ed25519 public key: %w", err)
+	}
+	factor, err := edwards25519.NewScalar().SetBytesWithClamping(blindingFactor(pub, period, length))
+	if err != nil {
+		return nil, err
+	}
+	return new(edwards25519.Point).ScalarMult(factor, point).Bytes(), nil
+}
+
+// blindingFactor returns the unclamped blinding factor h of pub for a time
+// period.
+func blindingFactor(pub ed25519.PublicKey, period int64, length time.Duration) []byte {
+	nonce := make([]byte, 0, 25)
+	nonce = append(nonce, "key-blind"...)
+	nonce = binary.BigEndian.AppendUint64(nonce, uint64(period))
+	nonce = binary.BigEndian.AppendUint64(nonce, uint64(length/time.Minute))
+
+	h := sha3.New256()
+	h.Write([]byte(blindString))
+	h.Write(pub)
+	h.Write([]byte(basepoint))
+	h.Write(nonce)
+	return h.Sum(nil)
+}
@@ -0,0 +1,197 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/edwards25519"
+)
+
+// Published v3 service IDs
+var testIDs = []string{
+	"pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd",
+	"duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad",
+}
+
+func TestIDRoundTrip(t *testing.T) {
+	for _, id := range testIDs {
+		pub, err := PublicKey(id + ".onion")
+		if err != nil {
+			t.Fatalf("PublicKey(%s): %v", id, err)
+		}
+		got, err := IDFromPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != id {
+			t.Errorf("IDFromPublicKey = %s, want %s", got, id)
+		}
+	}
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := IDFromPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != IDLength || ValidateID(id) != nil {
+		t.Errorf("Generated ID %s is invalid", id)
+	}
+	if _, err := IDFromPublicKey(pub[:31]); err == nil {
+		t.Error("Expected an error for a short public key")
+	}
+}
+
+func TestValidateID(t *testing.T) {
+	id := testIDs[0]
+	pub, _ := PublicKey(id)
+	raw := append(append([]byte(nil), pub...), checksum(pub)...)
+	v2 := strings.ToLower(encoding.EncodeToString(append(raw, 2)))
+
+	// Changing a character of the key breaks the checksum
+	typo := []byte(id)
+	typo[10] = 'a'
+	if typo[10] == id[10] {
+		typo[10] = 'b'
+	}
+
+	tests := []struct {
+		id   string
+		want error
+	}{
+		{id, nil},
+		{strings.ToUpper(id), nil},
+		{id[:55], ErrInvalidLength},
+		{id + "a", ErrInvalidLength},
+		{"0" + id[1:], ErrInvalidEncoding},
+		{v2, ErrInvalidVersion},
+		{string(typo), ErrInvalidChecksum},
+	}
+	for _, tt := range tests {
+		if err := ValidateID(tt.id); !errors.Is(err, tt.want) {
+			t.Errorf("ValidateID(%s) = %v, want %v", tt.id, err, tt.want)
+		}
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	id := testIDs[1]
+	tests := []struct {
+		in        string
+		subdomain string
+		port      int
+		str       string
+	}{
+		{id, "", 0, id + ".onion"},
+		{id + ".onion", "", 0, id + ".onion"},
+		{strings.ToUpper(id) + ".ONION.", "", 0, id + ".onion"},
+		{id + ".onion:443", "", 443, id + ".onion:443"},
+		{"www." + id + ".onion", "www", 0, "www." + id + ".onion"},
+		{"a.b." + id + ".onion:80", "a.b", 80, "a.b." + id + ".onion:80"},
+	}
+	for _, tt := range tests {
+		addr, err := ParseAddress(tt.in)
+		if err != nil {
+			t.Errorf("ParseAddress(%s): %v", tt.in, err)
+			continue
+		}
+		if addr.ID != id || addr.Subdomain != tt.subdomain || addr.Port != tt.port || addr.String() != tt.str {
+			t.Errorf("ParseAddress(%s) = %+v (%s)", tt.in, addr, addr)
+		}
+		if len(addr.PublicKey()) != ed25519.PublicKeySize {
+			t.Errorf("ParseAddress(%s) has no public key", tt.in)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"www." + id,
+		".." + id + ".onion",
+		id + ".onion:0",
+		id + ".onion:http",
+		"example.com",
+		id[:55] + "a.onion",
+	} {
+		if _, err := ParseAddress(in); err == nil {
+			t.Errorf("Expected an error for %q", in)
+		}
+	}
+}
+
+func TestTimePeriod(t *testing.T) {
+	// The example of the v3 rendezvous specification
+	at := time.Date(2016, 4, 13, 11, 0, 0, 0, time.UTC)
+	if got := TimePeriod(at, 0); got != 16903 {
+		t.Errorf("TimePeriod = %d, want 16903", got)
+	}
+	if got, want := TimePeriodStart(16903, 0), time.Date(2016, 4, 12, 12, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("TimePeriodStart = %s, want %s", got, want)
+	}
+	if got := TimePeriod(TimePeriodStart(16904, 0), DefaultPeriodLength); got != 16904 {
+		t.Errorf("Period starts in period %d, want 16904", got)
+	}
+	if got := TimePeriod(at, time.Hour); got != 405695 {
+		t.Errorf("TimePeriod with one hour periods = %d, want 405695", got)
+	}
+}
+
+func TestBlindPublicKeyVector(t *testing.T) {
+	// test_blinding_basics of Tor's test_hs_common.c
+	pub, _ := hex.DecodeString("833990B085C1A688C1D4C8B1F6B56AFAF5A2ECA674449E1D704F83765CCB7BC6")
+	at := time.Date(1973, 5, 20, 1, 50, 33, 0, time.UTC)
+	period := TimePeriod(at, 0)
+	if period != 1234 {
+		t.Fatalf("TimePeriod = %d, want 1234", period)
+	}
+	blinded, err := BlindPublicKey(pub, period, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(blinded), "3a50bf210e8f9ee955ae0014f7a6917fb65ebf098a86305abb508d1a7291b6d5"; got != want {
+		t.Errorf("BlindPublicKey = %s, want %s", got, want)
+	}
+}
+
+func TestBlindPublicKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blinded, err := BlindPublicKey(pub, 16903, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blinding the secret scalar gives the same key: h*(a*B) = (h*a)*B
+	digest := sha512.Sum512(priv.Seed())
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(digest[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := edwards25519.NewScalar().SetBytesWithClamping(blindingFactor(pub, 16903, DefaultPeriodLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(edwards25519.Point).ScalarBaseMult(new(edwards25519.Scalar).Multiply(h, a)).Bytes()
+	if string(blinded) != string(want) {
+		t.Error("Blinded public key does not match the blinded secret key")
+	}
+
+	next, err := BlindPublicKey(pub, 16904, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(next) == string(blinded) {
+		t.Error("Blinded keys of different periods are equal")
+	}
+	if _, err := BlindPublicKey(pub[:31], 16903, 0); err == nil {
+		t.Error("Expected an error for a short public key")
+	}
+}
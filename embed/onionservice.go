@@ -0,0 +1,634 @@
+package embed
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+// KeySource tells where the private key of an onion service came from.
+type KeySource int
+
+const (
+	// KeyExternal means the service was created outside the instance and
+	// only its address was recorded, with SetOnionAddress
+	KeyExternal KeySource = iota
+	// KeyGenerated means Tor generated a new key for the service
+	KeyGenerated
+	// KeyProvided means the caller passed the key in tor.ListenConf
+	KeyProvided
+	// KeyDirectory means Tor loads the key from a HiddenServiceDir
+	// configured in Config.OnionServices
+	KeyDirectory
+	// KeyStored means the key was loaded from, or generated and saved to,
+	// a KeyStore by ListenPersistent
+	KeyStored
+)
+
+var keySourceNames = map[KeySource]string{
+	KeyExternal:  "External",
+	KeyGenerated: "Generated",
+	KeyProvided:  "Provided",
+	KeyDirectory: "Directory",
+	KeyStored:    "Stored",
+}
+
+func (s KeySource) String() string {
+	if name, ok := keySourceNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// PublishStatus tells whether the descriptor of an onion service has
+// reached the network.
+type PublishStatus int
+
+const (
+	// PublishPending means no descriptor upload has completed yet
+	PublishPending PublishStatus = iota
+	// Published means at least one HSDir accepted the descriptor
+	Published
+	// PublishFailed means every upload attempted so far failed. Tor keeps
+	// retrying, so the service may still become Published.
+	PublishFailed
+)
+
+var publishStatusNames = map[PublishStatus]string{
+	PublishPending: "Pending",
+	Published:      "Published",
+	PublishFailed:  "Failed",
+}
+
+func (s PublishStatus) String() string {
+	if name, ok := publishStatusNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// OnionService describes an onion service in the registry of an Instance.
+type OnionService struct {
+	// ID is the service ID, the address without ".onion"
+	ID string
+
+	// Ports map the virtual ports of the service to their local targets
+	Ports []OnionPort
+
+	// KeySource tells where the private key came from
+	KeySource KeySource
+
+	// Dir is the service directory when KeySource is KeyDirectory
+	Dir string
+
+	// KeyName is the name of the key in the KeyStore when KeySource is
+	// KeyStored
+	KeyName string
+
+	// Created is when the service was added to the registry
+	Created time.Time
+
+	// Status is the publication status of the service descriptor. It is
+	// not tracked for KeyExternal services.
+	Status PublishStatus
+
+	// Clients are the names of the clients authorized with v3 client
+	// authorization, sorted, or nil if anyone with the address can connect
+	Clients []string
+
+	// address is the address given to SetOnionAddress, kept as is
+	address string
+}
+
+// Address returns the onion address of the service, ID followed by
+// ".onion". For a KeyExternal service it is the address exactly as given
+// to SetOnionAddress.
+func (s OnionService) Address() string {
+	if s.KeySource == KeyExternal {
+		return s.address
+	}
+	return s.ID + ".onion"
+}
+
+// OnionChangeKind is the kind of an OnionServiceChange.
+type OnionChangeKind int
+
+const (
+	// OnionAdded means the service was added to the registry
+	OnionAdded OnionChangeKind = iota
+	// OnionStatusChanged means the publication status of the service changed
+	OnionStatusChanged
+	// OnionRemoved means the service was removed from the registry
+	OnionRemoved
+	// OnionClientsChanged means clients of the service were authorized or
+	// revoked
+	OnionClientsChanged
+)
+
+var onionChangeNames = map[OnionChangeKind]string{
+	OnionAdded:          "Added",
+	OnionStatusChanged:  "StatusChanged",
+	OnionRemoved:        "Removed",
+	OnionClientsChanged: "ClientsChanged",
+}
+
+func (k OnionChangeKind) String() string {
+	if name, ok := onionChangeNames[k]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// OnionServiceChange describes a single change to the onion service
+// registry.
+type OnionServiceChange struct {
+	Kind OnionChangeKind
+
+	// Service is the service after the change, or as it was before its
+	// removal
+	Service OnionService
+}
+
+// onionBufferSize is the per-subscriber channel buffer
+const onionBufferSize = 16
+
+// onionRegistry holds the onion services of an Instance and the
+// subscribers to their changes.
+type onionRegistry struct {
+	mu       sync.Mutex
+	services []*OnionService
+	// uploads counts the descriptor uploads per service since the last
+	// UPLOADED, to tell when all of them failed
+	uploads map[string]int
+	nextID  int
+	subs    map[int]chan OnionServiceChange
+	// loading are the key names ListenPersistent is creating a service
+	// for, so two calls never load or generate the same key at once
+	loading map[string]bool
+}
+
+// OnionListener is an onion service created with Instance.Listen. It is a
+// net.Listener accepting the connections of the service; Close removes the
+// service from Tor and from the registry.
+type OnionListener struct {
+	*tor.OnionService
+
+	inst *Instance
+
+	// conf is the configuration the service was created with, to create
+	// it again when its clients change
+	conf tor.ListenConf
+
+	// mu guards clients and the service ID while clients change
+	mu      sync.Mutex
+	clients map[string]ClientPublicKey
+}
+
+// Close removes the onion service from Tor and the registry, and closes
+// the local listener if Listen created it.
+func (l *OnionListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inst.onions.remove(l.ID)
+	return l.OnionService.Close()
+}
+
+// Listen creates an onion service on the default instance.
+func Listen(ctx context.Context, conf *tor.ListenConf) (*OnionListener, error) {
+	return defaultInstance.Listen(ctx, conf)
+}
+
+// Listen creates an onion service with t.Listen on the running Tor and
+// records it in the registry, where it stays until it is closed or Tor
+// stops. Unless conf.NoWait is set, Listen waits until the descriptor is
+// published. It returns ErrNotRunning if Tor is not running.
+func (i *Instance) Listen(ctx context.Context, conf *tor.ListenConf) (*OnionListener, error) {
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	if conf == nil {
+		conf = &tor.ListenConf{}
+	}
+	record := &OnionService{KeySource: KeyGenerated}
+	if conf.Key != nil {
+		record.KeySource = KeyProvided
+	}
+	return i.listen(ctx, t, conf, record, nil)
+}
+
+// ListenPersistent creates an onion service on the default instance whose
+// key is kept under name in the configured KeyStore.
+func ListenPersistent(ctx context.Context, name string, conf *tor.ListenConf) (*OnionListener, error) {
+	return defaultInstance.ListenPersistent(ctx, name, conf)
+}
+
+// ListenPersistent is Listen for a service that keeps its address across
+// restarts. Its ed25519 key is loaded from the instance's KeyStore under
+// name, or generated and saved there first. The store is Config.KeyStore,
+// or the onion_keys directory of the data directory when it is not set.
+// conf.Key must be nil. A name can back only one live service at a time:
+// ListenPersistent fails while another service of the instance uses it.
+func (i *Instance) ListenPersistent(ctx context.Context, name string, conf *tor.ListenConf) (*OnionListener, error) {
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	var listenConf tor.ListenConf
+	if conf != nil {
+		if conf.Key != nil {
+			return nil, errors.New("ListenPersistent takes the key from the key store, conf.Key must be nil")
+		}
+		listenConf = *conf
+	}
+
+	// Hold the name until the service is in the registry
+	if !i.onions.reserveKeyName(name) {
+		return nil, fmt.Errorf("onion service key %q is already in use", name)
+	}
+	defer i.onions.releaseKeyName(name)
+
+	store := i.keyStore(t)
+	key, err := store.Load(name)
+	if errors.Is(err, ErrKeyNotFound) {
+		if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		if err = store.Save(name, key); err != nil {
+			return nil, fmt.Errorf("failed to save onion service key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load onion service key: %w", err)
+	}
+	listenConf.Key = key
+	return i.listen(ctx, t, &listenConf, &OnionService{KeySource: KeyStored, KeyName: name}, nil)
+}
+
+// keyStore returns the KeyStore of the running configuration, or the
+// default one in the data directory of t.
+func (i *Instance) keyStore(t *tor.Tor) KeyStore {
+	if applied := i.applied.Load(); applied != nil && applied.keyStore != nil {
+		return applied.keyStore
+	}
+	return NewFileKeyStore(filepath.Join(t.DataDir, onionKeysDir))
+}
+
+// listen creates the service, authorized to clients if there are any, and
+// completes record with it in the registry.
+func (i *Instance) listen(ctx context.Context, t *tor.Tor, conf *tor.ListenConf, record *OnionService,
+	clients map[string]ClientPublicKey) (*OnionListener, error) {
+	var svc *tor.OnionService
+	var err error
+	if len(clients) > 0 {
+		svc, err = listenAuthorized(ctx, t, conf, clients)
+	} else {
+		svc, err = t.Listen(ctx, conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Tor may have been stopped while the descriptor was published
+	if i.tor.Load() != t {
+		svc.Close()
+		return nil, ErrNotRunning
+	}
+
+	record.ID = svc.ID
+	record.Ports = listenerPorts(svc)
+	record.Created = time.Now()
+	record.Status = Published
+	if conf.NoWait {
+		record.Status = PublishPending
+	}
+	record.Clients = clientNames(clients)
+	i.onions.add(record)
+	return &OnionListener{OnionService: svc, inst: i, conf: *conf, clients: clients}, nil
+}
+
+// listenerPorts returns the ports of a service created by t.Listen, which
+// all forward to its local listener.
+func listenerPorts(svc *tor.OnionService) []OnionPort {
+	target := ""
+	if svc.LocalListener != nil {
+		target = svc.LocalListener.Addr().String()
+		if _, ok := svc.LocalListener.(*net.UnixListener); ok {
+			target = "unix:" + target
+		}
+	}
+	ports := make([]OnionPort, 0, len(svc.RemotePorts))
+	for _, p := range svc.RemotePorts {
+		ports = append(ports, OnionPort{Virtual: p, Target: target})
+	}
+	return ports
+}
+
+// OnionServices returns the onion services on the default instance.
+func OnionServices() []OnionService {
+	return defaultInstance.OnionServices()
+}
+
+// OnionServices returns the onion services in the registry in the order
+// they were added: those created with Listen, those of
+// Config.OnionServices and the address set with SetOnionAddress.
+func (i *Instance) OnionServices() []OnionService {
+	i.onions.mu.Lock()
+	defer i.onions.mu.Unlock()
+	services := make([]OnionService, 0, len(i.onions.services))
+	for _, s := range i.onions.services {
+		services = append(services, s.clone())
+	}
+	return services
+}
+
+// LookupOnionService returns the service with the given ID or address from
+// the registry.
+func (i *Instance) LookupOnionService(id string) (OnionService, bool) {
+	id = strings.TrimSuffix(id, ".onion")
+	i.onions.mu.Lock()
+	defer i.onions.mu.Unlock()
+	if s := i.onions.find(id); s != nil {
+		return s.clone(), true
+	}
+	return OnionService{}, false
+}
+
+// SubscribeOnionServices returns a channel that receives every subsequent
+// change to the onion service registry of the instance and a function
+// that ends the subscription and closes the channel. Changes are dropped
+// for a subscriber whose buffer is full, so slow consumers should call
+// OnionServices to resynchronize.
+func (i *Instance) SubscribeOnionServices() (<-chan OnionServiceChange, func()) {
+	r := &i.onions
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.subs == nil {
+		r.subs = map[int]chan OnionServiceChange{}
+	}
+	id := r.nextID
+	r.nextID++
+	ch := make(chan OnionServiceChange, onionBufferSize)
+	r.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.subs, id)
+			close(ch)
+		})
+	}
+}
+
+// OnionAddress returns the primary onion address of the instance: the one
+// set with SetOnionAddress if any, otherwise that of the first service in
+// the registry, or an empty string if there is none.
+func (i *Instance) OnionAddress() string {
+	i.onions.mu.Lock()
+	defer i.onions.mu.Unlock()
+	var first *OnionService
+	for _, s := range i.onions.services {
+		if s.KeySource == KeyExternal {
+			return s.Address()
+		}
+		if first == nil {
+			first = s
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	return first.Address()
+}
+
+// SetOnionAddress records the address of an onion service created outside
+// the instance, replacing the one recorded before. An empty addr removes
+// it. Services created with Listen are recorded without it. OnionAddress
+// returns addr exactly as given, with or without ".onion".
+func (i *Instance) SetOnionAddress(addr string) {
+	r := &i.onions
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.services {
+		if s.KeySource == KeyExternal {
+			r.removeLocked(s)
+			break
+		}
+	}
+	if addr != "" {
+		r.addLocked(&OnionService{
+			ID:        strings.TrimSuffix(addr, ".onion"),
+			KeySource: KeyExternal,
+			address:   addr,
+			Created:   time.Now(),
+		})
+	}
+}
+
+// clone returns a copy of s that shares nothing with it.
+func (s *OnionService) clone() OnionService {
+	c := *s
+	c.Ports = append([]OnionPort(nil), s.Ports...)
+	c.Clients = append([]string(nil), s.Clients...)
+	return c
+}
+
+func (r *onionRegistry) find(id string) *OnionService {
+	for _, s := range r.services {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (r *onionRegistry) add(s *OnionService) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addLocked(s)
+}
+
+func (r *onionRegistry) addLocked(s *OnionService) {
+	r.services = append(r.services, s)
+	r.notifyLocked(OnionAdded, s)
+}
+
+// reserveKeyName reserves a KeyStore name for a new service, failing if a
+// service of the registry uses it or another reservation holds it.
+func (r *onionRegistry) reserveKeyName(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loading[name] {
+		return false
+	}
+	for _, s := range r.services {
+		if s.KeySource == KeyStored && s.KeyName == name {
+			return false
+		}
+	}
+	if r.loading == nil {
+		r.loading = map[string]bool{}
+	}
+	r.loading[name] = true
+	return true
+}
+
+func (r *onionRegistry) releaseKeyName(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.loading, name)
+}
+
+// remove removes the service with the given ID that runs on Tor, leaving
+// an address set with SetOnionAddress alone.
+func (r *onionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.services {
+		if s.ID == id && s.KeySource != KeyExternal {
+			r.removeLocked(s)
+			return
+		}
+	}
+}
+
+func (r *onionRegistry) removeLocked(s *OnionService) {
+	for n, other := range r.services {
+		if other == s {
+			r.services = append(r.services[:n:n], r.services[n+1:]...)
+			delete(r.uploads, s.ID)
+			r.notifyLocked(OnionRemoved, s)
+			return
+		}
+	}
+}
+
+// clear removes the services that run on Tor, keeping the address set
+// with SetOnionAddress, which the application manages.
+func (r *onionRegistry) clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range append([]*OnionService(nil), r.services...) {
+		if s.KeySource != KeyExternal {
+			r.removeLocked(s)
+		}
+	}
+}
+
+// setClients records the authorized clients of the service with the given
+// ID after it was created again with them. Its descriptor is published
+// anew.
+func (r *onionRegistry) setClients(id string, clients []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.services {
+		if s.ID == id && s.KeySource != KeyExternal {
+			s.Clients = clients
+			s.Status = PublishPending
+			delete(r.uploads, s.ID)
+			r.notifyLocked(OnionClientsChanged, s)
+			return
+		}
+	}
+}
+
+// notifyLocked sends a change to every subscriber without blocking.
+func (r *onionRegistry) notifyLocked(kind OnionChangeKind, s *OnionService) {
+	change := OnionServiceChange{Kind: kind, Service: s.clone()}
+	for _, ch := range r.subs {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// descEvent updates the publication status of a service from an HS_DESC
+// event. Tor uploads each descriptor to several HSDirs; one success is
+// enough, and the service has failed only once every attempt has.
+func (r *onionRegistry) descEvent(evt *control.HSDescEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.find(evt.Address)
+	if s == nil || s.KeySource == KeyExternal {
+		return
+	}
+	if r.uploads == nil {
+		r.uploads = map[string]int{}
+	}
+
+	status := s.Status
+	switch evt.Action {
+	case "UPLOAD":
+		r.uploads[s.ID]++
+		return
+	case "UPLOADED":
+		delete(r.uploads, s.ID)
+		status = Published
+	case "FAILED":
+		if r.uploads[s.ID]--; r.uploads[s.ID] <= 0 && s.Status != Published {
+			delete(r.uploads, s.ID)
+			status = PublishFailed
+		}
+	default:
+		return
+	}
+	if status != s.Status {
+		s.Status = status
+		r.notifyLocked(OnionStatusChanged, s)
+	}
+}
+
+// syncDirServices records the services of Config.OnionServices, and
+// removes those no longer configured, after Tor loaded them. Tor writes
+// the address of each to the hostname file in its directory; a service
+// whose hostname can't be read is skipped.
+func (r *onionRegistry) syncDirServices(configs []OnionServiceConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	configured := map[string]bool{}
+	for _, c := range configs {
+		data, err := os.ReadFile(filepath.Join(c.Dir, hostnameFile))
+		if err != nil {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimSpace(string(data)), ".onion")
+		configured[id] = true
+		ports := append([]OnionPort(nil), c.Ports...)
+		for n, p := range ports {
+			if p.Target == "" {
+				ports[n].Target = "127.0.0.1:" + strconv.Itoa(p.Virtual)
+			}
+		}
+		if s := r.find(id); s != nil && s.KeySource == KeyDirectory {
+			s.Ports, s.Dir = ports, c.Dir
+			continue
+		}
+		r.addLocked(&OnionService{
+			ID:        id,
+			Ports:     ports,
+			KeySource: KeyDirectory,
+			Dir:       c.Dir,
+			Created:   time.Now(),
+		})
+	}
+	for _, s := range append([]*OnionService(nil), r.services...) {
+		if s.KeySource == KeyDirectory && !configured[s.ID] {
+			r.removeLocked(s)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+const testOnionID = "pg6mmjiyjmcrsslvykfwnntlaru7p5svn6y2ymmju6nubxndf4pscryd"
+
+func TestSetOnionAddressRegistry(t *testing.T) {
+	inst := NewInstance()
+	changes, cancel := inst.SubscribeOnionServices()
+	defer cancel()
+
+	inst.SetOnionAddress(testOnionID + ".onion")
+	services := inst.OnionServices()
+	if len(services) != 1 || services[0].ID != testOnionID || services[0].KeySource != KeyExternal {
+		t.Fatalf("Unexpected services: %+v", services)
+	}
+	if c := <-changes; c.Kind != OnionAdded || c.Service.ID != testOnionID {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+
+	// A second address replaces the first
+	inst.SetOnionAddress("other.onion")
+	if c := <-changes; c.Kind != OnionRemoved || c.Service.ID != testOnionID {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+	if c := <-changes; c.Kind != OnionAdded || c.Service.Address() != "other.onion" {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+	if _, ok := inst.LookupOnionService(testOnionID); ok {
+		t.Error("Replaced address should be gone")
+	}
+
+	inst.SetOnionAddress("")
+	if len(inst.OnionServices()) != 0 || inst.OnionAddress() != "" {
+		t.Error("Empty address should clear the registry")
+	}
+}
+
+func TestSetOnionAddressVerbatim(t *testing.T) {
+	inst := NewInstance()
+	for _, addr := range []string{"abc", testOnionID, testOnionID + ".onion"} {
+		inst.SetOnionAddress(addr)
+		if got := inst.OnionAddress(); got != addr {
+			t.Errorf("OnionAddress() = %q after SetOnionAddress(%q)", got, addr)
+		}
+	}
+	if _, ok := inst.LookupOnionService(testOnionID); !ok {
+		t.Error("Expected the external service under its ID")
+	}
+}
+
+func TestOnionAddressPrefersExternal(t *testing.T) {
+	inst := NewInstance()
+	inst.onions.add(&OnionService{ID: testOnionID, KeySource: KeyGenerated})
+	if got := inst.OnionAddress(); got != testOnionID+".onion" {
+		t.Errorf("Got %q, want the first service", got)
+	}
+	inst.SetOnionAddress("manual.onion")
+	if got := inst.OnionAddress(); got != "manual.onion" {
+		t.Errorf("Got %q, want the address set with SetOnionAddress", got)
+	}
+
+	// Stopping Tor only removes the services that ran on it
+	inst.onions.clear()
+	services := inst.OnionServices()
+	if len(services) != 1 || services[0].KeySource != KeyExternal {
+		t.Errorf("Unexpected services after clear: %+v", services)
+	}
+}
+
+func TestOnionPublishStatus(t *testing.T) {
+	inst := NewInstance()
+	inst.onions.add(&OnionService{ID: testOnionID, KeySource: KeyProvided})
+	changes, cancel := inst.SubscribeOnionServices()
+	defer cancel()
+
+	desc := func(action string) {
+		inst.onions.descEvent(&control.HSDescEvent{Action: action, Address: testOnionID})
+	}
+	status := func() PublishStatus {
+		svc, _ := inst.LookupOnionService(testOnionID)
+		return svc.Status
+	}
+
+	desc("UPLOAD")
+	desc("UPLOAD")
+	desc("FAILED")
+	if status() != PublishPending {
+		t.Errorf("One of two uploads failed, got %s", status())
+	}
+	desc("FAILED")
+	if status() != PublishFailed {
+		t.Errorf("All uploads failed, got %s", status())
+	}
+	if c := <-changes; c.Kind != OnionStatusChanged || c.Service.Status != PublishFailed {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+
+	desc("UPLOAD")
+	desc("UPLOADED")
+	desc("FAILED")
+	if status() != Published {
+		t.Errorf("An upload succeeded, got %s", status())
+	}
+	if c := <-changes; c.Kind != OnionStatusChanged || c.Service.Status != Published {
+		t.Errorf("Unexpected change: %+v", c)
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("Failures after publication should not be reported: %+v", c)
+	default:
+	}
+}
+
+func TestSyncDirServices(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hs")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "hostname"), []byte(testOnionID+".onion\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	inst := NewInstance()
+	configs := []OnionServiceConfig{
+		{Dir: dir, Ports: []OnionPort{{Virtual: 80}}},
+		{Dir: filepath.Join(dir, "missing"), Ports: []OnionPort{{Virtual: 22}}},
+	}
+	inst.onions.syncDirServices(configs)
+	svc, ok := inst.LookupOnionService(testOnionID + ".onion")
+	if !ok {
+		t.Fatal("Service of the configured directory not registered")
+	}
+	if svc.KeySource != KeyDirectory || svc.Dir != dir || len(svc.Ports) != 1 || svc.Ports[0].Target != "127.0.0.1:80" {
+		t.Errorf("Unexpected service: %+v", svc)
+	}
+	if len(inst.OnionServices()) != 1 {
+		t.Errorf("Service without hostname should be skipped: %+v", inst.OnionServices())
+	}
+
+	inst.onions.syncDirServices(nil)
+	if len(inst.OnionServices()) != 0 {
+		t.Error("Unconfigured service should be removed")
+	}
+}
+
+func TestListenNotRunning(t *testing.T) {
+	_, err := NewInstance().Listen(context.Background(), &tor.ListenConf{Version3: true})
+	if !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package embed
+
+import "strings"
+
+// torOptionNames lists the configuration options understood by Tor 0.4.8,
+// used to reject unknown options before Tor is launched. Options starting
+// with "Testing" or "__" are accepted without being listed.
+var torOptionNames = []string{
+	// General
+	"AccelDir", "AccelName", "AlternateBridgeAuthority", "AlternateDirAuthority",
+	"AndroidIdentityTag", "AvoidDiskWrites", "BandwidthBurst", "BandwidthRate",
+	"CacheDirectory", "CacheDirectoryGroupReadable", "CircuitPriorityHalflife",
+	"ClientTransportPlugin", "ConfluxClientUFP", "ConfluxEnabled", "ConnLimit",
+	"ConstrainedSockSize", "ConstrainedSockets", "ControlPort",
+	"ControlPortFileGroupReadable", "ControlPortWriteToFile", "ControlSocket",
+	"ControlSocketsGroupWritable", "CookieAuthFile", "CookieAuthFileGroupReadable",
+	"CookieAuthentication", "CountPrivateBandwidth", "DataDirectory",
+	"DataDirectoryGroupReadable", "DirAuthority", "DirAuthorityFallbackRate",
+	"DisableAllSwap", "DisableDebuggerAttachment", "DisableNetwork",
+	"ExtendByEd25519ID", "ExtORPort", "ExtORPortCookieAuthFile",
+	"ExtORPortCookieAuthFileGroupReadable", "FallbackDir", "FetchDirInfoEarly",
+	"FetchDirInfoExtraEarly", "FetchHidServDescriptors", "FetchServerDescriptors",
+	"FetchUselessDescriptors", "HardwareAccel", "HashedControlPassword",
+	"HTTPProxy", "HTTPProxyAuthenticator", "HTTPSProxy", "HTTPSProxyAuthenticator",
+	"KeepalivePeriod", "KeepBindCapabilities", "KISTSchedRunInterval",
+	"KISTSockBufSizeFactor", "Log", "LogMessageDomains", "LogTimeGranularity",
+	"MaxAdvertisedBandwidth", "MaxUnparseableDescSizeToLog", "MetricsPort",
+	"MetricsPortPolicy", "NoExec", "OutboundBindAddress", "OutboundBindAddressExit",
+	"OutboundBindAddressOR", "OutboundBindAddressPT", "PerConnBWBurst",
+	"PerConnBWRate", "PidFile", "ProtocolWarnings", "RelayBandwidthBurst",
+	"RelayBandwidthRate", "RephistTrackTime", "RunAsDaemon", "SafeLogging",
+	"Sandbox", "Schedulers", "Socks4Proxy", "Socks5Proxy", "Socks5ProxyPassword",
+	"Socks5ProxyUsername", "SyslogIdentityTag", "TCPProxy", "TruncateLogFile",
+	"UnixSocksGroupWritable", "UseDefaultFallbackDirs", "User",
+
+	// Client
+	"AllowNonRFC953Hostnames", "AutomapHostsOnResolve", "AutomapHostsSuffixes",
+	"Bridge", "CircuitBuildTimeout", "CircuitPadding", "CircuitsAvailableTimeout",
+	"CircuitStreamTimeout", "ClientAutoIPv6ORPort",
+	"ClientBootstrapConsensusAuthorityDownloadInitialDelay",
+	"ClientBootstrapConsensusAuthorityOnlyDownloadInitialDelay",
+	"ClientBootstrapConsensusFallbackDownloadInitialDelay",
+	"ClientBootstrapConsensusMaxInProgressTries", "ClientDNSRejectInternalAddresses",
+	"ClientOnionAuthDir", "ClientOnly", "ClientPreferIPv6DirPort",
+	"ClientPreferIPv6ORPort", "ClientRejectInternalAddresses", "ClientUseIPv4",
+	"ClientUseIPv6", "ConnectionPadding", "DNSPort", "DormantCanceledByStartup",
+	"DormantClientTimeout", "DormantOnFirstStartup",
+	"DormantTimeoutDisabledByIdleStreams", "DormantTimeoutEnabled",
+	"DownloadExtraInfo", "EnforceDistinctSubnets", "FascistFirewall",
+	"FirewallPorts", "GuardfractionFile", "GuardLifetime", "HTTPTunnelPort",
+	"LearnCircuitBuildTimeout", "LongLivedPorts", "MapAddress",
+	"MaxCircuitDirtiness", "MaxClientCircuitsPending", "NATDPort",
+	"NewCircuitPeriod", "NumDirectoryGuards", "NumEntryGuards", "NumPrimaryGuards",
+	"PathBiasCircThreshold", "PathBiasDropGuards", "PathBiasExtremeRate",
+	"PathBiasExtremeUseRate", "PathBiasNoticeRate", "PathBiasNoticeUseRate",
+	"PathBiasScaleThreshold", "PathBiasScaleUseThreshold", "PathBiasUseThreshold",
+	"PathBiasWarnRate", "PathsNeededToBuildCircuits", "ReachableAddresses",
+	"ReachableDirAddresses", "ReachableORAddresses", "ReducedCircuitPadding",
+	"ReducedConnectionPadding", "RejectPlaintextPorts", "SafeSocks", "SocksPolicy",
+	"SocksPort", "SocksTimeout", "TestSocks", "TokenBucketRefillInterval",
+	"TrackHostExits", "TrackHostExitsExpire", "TransPort", "TransProxyType",
+	"UpdateBridgesFromAuthority", "UseBridges", "UseEntryGuards",
+	"UseGuardFraction", "UseMicrodescriptors", "VanguardsLiteEnabled",
+	"VirtualAddrNetworkIPv4", "VirtualAddrNetworkIPv6", "WarnPlaintextPorts",
+
+	// Node selection
+	"EntryNodes", "ExcludeExitNodes", "ExcludeNodes", "ExitNodes",
+	"GeoIPExcludeUnknown", "HSLayer2Nodes", "HSLayer3Nodes", "MiddleNodes",
+	"NodeFamily", "StrictNodes",
+
+	// Server
+	"AccountingMax", "AccountingRule", "AccountingStart", "Address",
+	"AddressDisableIPv6", "AssumeReachable", "AssumeReachableIPv6",
+	"BridgeDistribution", "BridgeRecordUsageByCountry", "BridgeRelay",
+	"CellStatistics", "ConnDirectionStatistics", "ContactInfo", "DirCache",
+	"DirPolicy", "DirPort", "DirPortFrontPage", "DirReqStatistics",
+	"DisableOOSCheck", "EntryStatistics", "ExitPolicy",
+	"ExitPolicyRejectLocalInterfaces", "ExitPolicyRejectPrivate", "ExitPortStatistics",
+	"ExitRelay", "ExtendAllowPrivateAddresses", "ExtraInfoStatistics", "GeoIPFile",
+	"GeoIPv6File", "HeartbeatPeriod", "HiddenServiceStatistics", "IPv6Exit",
+	"KeyDirectory", "KeyDirectoryGroupReadable", "MainloopStats",
+	"MaxConsensusAgeForDiffs", "MaxMemInQueues", "MaxOnionQueueDelay", "MyFamily",
+	"Nickname", "NumCPUs", "OfflineMasterKey", "ORPort", "OverloadStatistics",
+	"PaddingStatistics", "PublishServerDescriptor", "ReducedExitPolicy",
+	"RefuseUnknownExits", "ServerDNSAllowBrokenConfig",
+	"ServerDNSAllowNonRFC953Hostnames", "ServerDNSDetectHijacking",
+	"ServerDNSRandomizeCase", "ServerDNSResolvConfFile", "ServerDNSSearchDomains",
+	"ServerDNSTestAddresses", "ServerTransportListenAddr", "ServerTransportOptions",
+	"ServerTransportPlugin", "ShutdownWaitLength", "SigningKeyLifetime",
+	"SSLKeyLifetime",
+
+	// Denial of service mitigation
+	"DoSCircuitCreationBurst", "DoSCircuitCreationDefenseTimePeriod",
+	"DoSCircuitCreationDefenseType", "DoSCircuitCreationEnabled",
+	"DoSCircuitCreationMinConnections", "DoSCircuitCreationRate",
+	"DoSConnectionConnectBurst", "DoSConnectionConnectDefenseTimePeriod",
+	"DoSConnectionConnectRate", "DoSConnectionDefenseType", "DoSConnectionEnabled",
+	"DoSConnectionMaxConcurrentCount", "DoSRefuseSingleHopClientRendezvous",
+	"DoSStreamCreationBurst", "DoSStreamCreationDefenseType",
+	"DoSStreamCreationEnabled", "DoSStreamCreationRate",
+
+	// Directory authority
+	"AuthDirBadExit", "AuthDirBadExitCCs", "AuthDirFastGuarantee",
+	"AuthDirGuardBWGuarantee", "AuthDirHasIPv6Connectivity", "AuthDirInvalid",
+	"AuthDirInvalidCCs", "AuthDirListBadExits", "AuthDirListMiddleOnly",
+	"AuthDirMaxServersPerAddr", "AuthDirMiddleOnly", "AuthDirMiddleOnlyCCs",
+	"AuthDirPinKeys", "AuthDirReject", "AuthDirRejectCCs",
+	"AuthDirRejectRequestsUnderLoad", "AuthDirSharedRandomness",
+	"AuthDirTestEd25519LinkKeys", "AuthDirTestReachability", "AuthDirVoteGuard",
+	"AuthDirVoteGuardBwThresholdFraction", "AuthDirVoteGuardGuaranteeTimeKnown",
+	"AuthDirVoteGuardGuaranteeWFU", "AuthDirVoteStableGuaranteeMinUptime",
+	"AuthDirVoteStableGuaranteeMTBF", "AuthoritativeDirectory",
+	"BridgeAuthoritativeDir", "BridgePassword", "ConsensusParams",
+	"DirAllowPrivateAddresses", "MinMeasuredBWsForAuthToIgnoreAdvertised",
+	"MinUptimeHidServDirectoryV2", "RecommendedClientVersions",
+	"RecommendedServerVersions", "RecommendedVersions", "V3AuthDistDelay",
+	"V3AuthNIntervalsValid", "V3AuthoritativeDirectory", "V3AuthUseLegacyKey",
+	"V3AuthVoteDelay", "V3AuthVotingInterval", "V3BandwidthsFile",
+	"VersioningAuthoritativeDirectory",
+
+	// Onion services
+	"HiddenServiceAllowUnknownPorts", "HiddenServiceDir",
+	"HiddenServiceDirGroupReadable", "HiddenServiceEnableIntroDoSBurstPerSec",
+	"HiddenServiceEnableIntroDoSDefense", "HiddenServiceEnableIntroDoSRatePerSec",
+	"HiddenServiceExportCircuitID", "HiddenServiceMaxStreams",
+	"HiddenServiceMaxStreamsCloseCircuit", "HiddenServiceNonAnonymousMode",
+	"HiddenServiceNumIntroductionPoints", "HiddenServiceOnionBalanceInstance",
+	"HiddenServicePort", "HiddenServicePoWDefensesEnabled",
+	"HiddenServicePoWQueueBurst", "HiddenServicePoWQueueRate",
+	"HiddenServiceSingleHopMode", "HiddenServiceVersion",
+	"PublishHidServDescriptors", "CompiledProofOfWorkHash",
+}
+
+// perServiceOptions are the options that belong to the HiddenServiceDir
+// block they follow
+var perServiceOptions = map[string]bool{
+	"HiddenServicePort": true, "HiddenServiceVersion": true,
+	"HiddenServiceMaxStreams": true, "HiddenServiceMaxStreamsCloseCircuit": true,
+	"HiddenServiceNumIntroductionPoints": true, "HiddenServiceAllowUnknownPorts": true,
+	"HiddenServiceDirGroupReadable": true, "HiddenServiceExportCircuitID": true,
+	"HiddenServiceEnableIntroDoSDefense": true, "HiddenServiceEnableIntroDoSRatePerSec": true,
+	"HiddenServiceEnableIntroDoSBurstPerSec": true, "HiddenServiceOnionBalanceInstance": true,
+	"HiddenServicePoWDefensesEnabled": true, "HiddenServicePoWQueueRate": true,
+	"HiddenServicePoWQueueBurst": true,
+}
+
+// optionNames maps lower-case option names to their canonical spelling
+var optionNames = func() map[string]string {
+	names := make(map[string]string, len(torOptionNames))
+	for _, name := range torOptionNames {
+		names[strings.ToLower(name)] = name
+	}
+	return names
+}()
+
+// canonicalOption returns the canonical spelling of a Tor option name and
+// whether Tor knows it. Tor matches option names case-insensitively.
+func canonicalOption(name string) (string, bool) {
+	if canonical, ok := optionNames[strings.ToLower(name)]; ok {
+		return canonical, true
+	}
+	if strings.HasPrefix(name, "__") || strings.HasPrefix(strings.ToLower(name), "testing") {
+		return name, name != "__" && !strings.EqualFold(name, "testing")
+	}
+	return name, false
+}
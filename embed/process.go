@@ -0,0 +1,80 @@
+package embed
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cretz/bine/process"
+)
+
+// watchedCreator wraps a process.Creator so the processes it creates can be
+// observed by the lifecycle watcher.
+type watchedCreator struct {
+	process.Creator
+
+	// last is the most recently created process
+	last *watchedProcess
+}
+
+// New implements process.Creator.New
+func (c *watchedCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	p, err := c.Creator.New(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.last = &watchedProcess{Process: p, done: make(chan struct{})}
+	return c.last, nil
+}
+
+// watchedProcess lets any number of goroutines wait for a process to exit.
+// process.Process.Wait may only be called once, but both tor.Tor.Close and
+// the lifecycle watcher need to know when Tor is gone.
+type watchedProcess struct {
+	process.Process
+
+	// done is closed once the process has exited and err is set
+	done chan struct{}
+	err  error
+}
+
+// Start implements process.Process.Start
+func (p *watchedProcess) Start() error {
+	if err := p.Process.Start(); err != nil {
+		return err
+	}
+	go func() {
+		p.err = p.Process.Wait()
+		close(p.done)
+	}()
+	return nil
+}
+
+// Wait implements process.Process.Wait
+func (p *watchedProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+// kill kills the process outright if it can be, as a child process can.
+func (p *watchedProcess) kill() {
+	if k, ok := p.Process.(interface{ Kill() error }); ok {
+		k.Kill()
+	}
+}
+
+// exitError returns the process's *ExitError if it has already exited with
+// one. It does not block and is safe to call on a nil process.
+func (p *watchedProcess) exitError() *ExitError {
+	if p == nil {
+		return nil
+	}
+	select {
+	case <-p.done:
+		var exitErr *ExitError
+		if errors.As(p.err, &exitErr) {
+			return exitErr
+		}
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package embed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshot file names, as Tor names them in its data directory.
+const (
+	consensusFile    = "cached-microdesc-consensus"
+	microdescsFile   = "cached-microdescs"
+	certsFile        = "cached-certs"
+	consensusTimeFmt = "2006-01-02 15:04:05"
+)
+
+// snapshotFiles are the files SeedDataDir copies. The microdescriptors are
+// optional: without them Tor only fetches those.
+var snapshotFiles = []string{consensusFile, certsFile, microdescsFile}
+
+// maxConsensusSkew is how far a consensus may seem to be from the future
+// before it is rejected.
+const maxConsensusSkew = time.Hour
+
+// SnapshotInfo describes the consensus of a directory snapshot.
+type SnapshotInfo struct {
+	// ValidAfter, FreshUntil and ValidUntil are the consensus lifetime
+	ValidAfter time.Time
+	FreshUntil time.Time
+	ValidUntil time.Time
+}
+
+// Fresh reports whether the consensus is still usable at now.
+func (s *SnapshotInfo) Fresh(now time.Time) bool {
+	return !now.Before(s.ValidAfter.Add(-maxConsensusSkew)) && now.Before(s.ValidUntil)
+}
+
+// CheckSnapshot reads the directory snapshot in fsys, a directory holding
+// cached-microdesc-consensus, cached-certs and optionally cached-microdescs,
+// and returns the lifetime of its consensus. It returns an error wrapping
+// ErrSnapshotStale if the consensus is no longer, or not yet, valid.
+func CheckSnapshot(fsys fs.FS) (*SnapshotInfo, error) {
+	f, err := fsys.Open(consensusFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	defer f.Close()
+	info, err := readConsensusInfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", consensusFile, err)
+	}
+
+	certs, err := fsys.Open(certsFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	defer certs.Close()
+	line, err := bufio.NewReader(certs).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "dir-key-certificate-version ") {
+		return nil, fmt.Errorf("invalid snapshot %s: not a certificate list", certsFile)
+	}
+
+	if !info.Fresh(time.Now()) {
+		return info, fmt.Errorf("consensus valid from %s until %s: %w",
+			info.ValidAfter.Format(consensusTimeFmt), info.ValidUntil.Format(consensusTimeFmt), ErrSnapshotStale)
+	}
+	return info, nil
+}
+
+// SeedDataDir copies the directory snapshot in fsys into dataDir so Tor can
+// bootstrap without downloading the consensus and microdescriptors first.
+// The snapshot is checked with CheckSnapshot and a stale one is not used.
+// If dataDir already holds a consensus at least as recent, it is kept and
+// nothing is copied. Tor must not be running on dataDir.
+//
+// Use os.DirFS for a snapshot on disk, or go:embed to bundle one with the
+// application. Config.Snapshot seeds the data directory as part of Start.
+func SeedDataDir(dataDir string, fsys fs.FS) error {
+	info, err := CheckSnapshot(fsys)
+	if err != nil {
+		return err
+	}
+	if err := prepareDataDir(dataDir); err != nil {
+		return err
+	}
+
+	if f, err := os.Open(filepath.Join(dataDir, consensusFile)); err == nil {
+		existing, err := readConsensusInfo(f)
+		f.Close()
+		if err == nil && !existing.ValidAfter.Before(info.ValidAfter) {
+			return nil
+		}
+	}
+
+	for _, name := range snapshotFiles {
+		err := copySnapshotFile(fsys, name, filepath.Join(dataDir, name))
+		if errors.Is(err, fs.ErrNotExist) && name == microdescsFile {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to seed %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// readConsensusInfo reads the lifetime from a consensus header.
+func readConsensusInfo(r io.Reader) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{}
+	times := map[string]*time.Time{
+		"valid-after": &info.ValidAfter,
+		"fresh-until": &info.FreshUntil,
+		"valid-until": &info.ValidUntil,
+	}
+
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() || scanner.Text() != "network-status-version 3 microdesc" {
+		return nil, errors.New("not a microdescriptor consensus")
+	}
+	for found := 0; found < len(times) && scanner.Scan(); {
+		key, val, _ := strings.Cut(scanner.Text(), " ")
+		if key == "dir-source" {
+			// The header is over
+			break
+		}
+		if t, ok := times[key]; ok {
+			parsed, err := time.Parse(consensusTimeFmt, val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*t = parsed
+			found++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if info.ValidAfter.IsZero() || info.ValidUntil.IsZero() {
+		return nil, errors.New("missing valid-after or valid-until")
+	}
+	return info, nil
+}
+
+// copySnapshotFile copies name from fsys to path, replacing it atomically.
+func copySnapshotFile(fsys fs.FS, name, path string) error {
+	src, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), path)
+}
@@ -0,0 +1,68 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func testSnapshot(validAfter time.Time) fstest.MapFS {
+	consensus := fmt.Sprintf("network-status-version 3 microdesc\nvote-status consensus\n"+
+		"valid-after %s\nfresh-until %s\nvalid-until %s\ndir-source moria1\n",
+		validAfter.Format(consensusTimeFmt),
+		validAfter.Add(time.Hour).Format(consensusTimeFmt),
+		validAfter.Add(3*time.Hour).Format(consensusTimeFmt))
+	return fstest.MapFS{
+		consensusFile:  {Data: []byte(consensus)},
+		certsFile:      {Data: []byte("dir-key-certificate-version 3\nfingerprint ABCD\n")},
+		microdescsFile: {Data: []byte("onion-key\n")},
+	}
+}
+
+func TestCheckSnapshot(t *testing.T) {
+	validAfter := time.Now().UTC().Truncate(time.Hour)
+	info, err := CheckSnapshot(testSnapshot(validAfter))
+	if err != nil {
+		t.Fatalf("CheckSnapshot failed: %v", err)
+	}
+	if !info.ValidAfter.Equal(validAfter) || !info.ValidUntil.Equal(validAfter.Add(3*time.Hour)) {
+		t.Errorf("Unexpected snapshot info: %+v", info)
+	}
+
+	if _, err := CheckSnapshot(testSnapshot(validAfter.Add(-24 * time.Hour))); !errors.Is(err, ErrSnapshotStale) {
+		t.Errorf("Expected ErrSnapshotStale for an old consensus, got %v", err)
+	}
+
+	missing := testSnapshot(validAfter)
+	delete(missing, certsFile)
+	if _, err := CheckSnapshot(missing); err == nil {
+		t.Error("Expected error for a snapshot without certificates")
+	}
+}
+
+func TestSeedDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	validAfter := time.Now().UTC().Truncate(time.Hour)
+	snapshot := testSnapshot(validAfter)
+	delete(snapshot, microdescsFile)
+	if err := SeedDataDir(dir, snapshot); err != nil {
+		t.Fatalf("SeedDataDir failed: %v", err)
+	}
+	for _, name := range []string{consensusFile, certsFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Expected %s to be seeded: %v", name, err)
+		}
+	}
+
+	// An older snapshot does not replace a newer consensus
+	if err := SeedDataDir(dir, testSnapshot(validAfter.Add(-time.Hour))); err != nil {
+		t.Fatalf("SeedDataDir failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, microdescsFile)); !os.IsNotExist(err) {
+		t.Error("Expected the older snapshot to be skipped")
+	}
+}
@@ -0,0 +1,245 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil"
+)
+
+// Listeners describes the listeners Tor actually opened, as reported by
+// GETINFO net/listeners/*. Each entry is an address such as
+// "127.0.0.1:9050" or "unix:/path/to/socket"; for "auto" listeners it holds
+// the port Tor picked.
+type Listeners struct {
+	// Socks are the SOCKS proxy listeners
+	Socks []string
+
+	// Control are the TCP or unix control listeners. The embedded control
+	// connection is not a listener and is never included.
+	Control []string
+
+	// DNS, Trans and HTTPTunnel are the DNS, transparent proxy and HTTP
+	// CONNECT listeners
+	DNS        []string
+	Trans      []string
+	HTTPTunnel []string
+}
+
+// SocksAddr returns the first SOCKS listener, or "" if there is none.
+func (l *Listeners) SocksAddr() string {
+	if len(l.Socks) == 0 {
+		return ""
+	}
+	return l.Socks[0]
+}
+
+// Start starts Tor on the default instance with the given configuration.
+// See Instance.Start.
+func Start(ctx context.Context, config *Config) (*tor.Tor, error) {
+	return defaultInstance.Start(ctx, config)
+}
+
+// Start starts Tor for this instance using every field of config. The
+// configuration is checked first, failing with *ConfigError values before
+// anything is launched. The data directory is created if needed and
+// checked to be a writable directory owned by the current user, not in use
+// by another Tor and with owner-only permissions, the listener and client
+// options are passed to Tor, and Start waits for bootstrap for at most
+// config.BootstrapTimeout (or until ctx is done when the timeout is zero).
+// A nil config uses DefaultConfig. It returns ErrAlreadyRunning, without
+// touching the data directory, if Tor is already running. The listeners
+// Tor opened are available from Listeners once Start returns, and Apply
+// changes the configuration of the running Tor.
+func (i *Instance) Start(ctx context.Context, config *Config) (*tor.Tor, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	if config.Ephemeral {
+		dir, err := newEphemeralDataDir()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral := *config
+		ephemeral.DataDir = dir
+		ephemeral.Directory.AvoidDiskWrites = true
+		config = &ephemeral
+	}
+
+	t, err := i.start(ctx, config)
+	if err != nil && config.Ephemeral {
+		os.RemoveAll(config.DataDir)
+	}
+	return t, err
+}
+
+func (i *Instance) start(ctx context.Context, config *Config) (*tor.Tor, error) {
+	args, err := config.Args()
+	if err != nil {
+		return nil, err
+	}
+	if config.ControlPort == DisabledPort && !i.embedded {
+		return nil, &ConfigError{Option: "ControlPort", Value: "0",
+			Err: fmt.Errorf("%w: a separate tor process needs a control port", ErrConflictingOptions)}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Leave the filesystem alone if Tor is already running
+	if err := i.checkStartLocked(); err != nil {
+		return nil, err
+	}
+	if err := prepareDataDir(config.DataDir); err != nil {
+		return nil, err
+	}
+	if err := prepareSocketDirs(config); err != nil {
+		return nil, err
+	}
+	if config.Snapshot != nil {
+		if err := SeedDataDir(config.DataDir, config.Snapshot); err != nil && !errors.Is(err, ErrSnapshotStale) {
+			return nil, err
+		}
+	}
+
+	t, err := i.startLocked(ctx, config.DataDir, args,
+		logOptions{logger: config.Logger, level: config.LogLevel})
+	if err != nil {
+		return nil, err
+	}
+	if config.Ephemeral {
+		i.ephemeralDir.Store(&config.DataDir)
+	}
+	i.applied.Store(newAppliedConfig(config))
+	i.onions.syncDirServices(config.OnionServices)
+
+	bootCtx := ctx
+	if config.BootstrapTimeout > 0 {
+		var cancel context.CancelFunc
+		bootCtx, cancel = context.WithTimeout(ctx, config.BootstrapTimeout)
+		defer cancel()
+	}
+
+	if err := i.bootstrapLocked(bootCtx, t, config.OnBootstrap); err != nil {
+		return nil, err
+	}
+
+	// Listeners are only opened once the network is enabled
+	listeners, err := queryListeners(t.Control)
+	if err != nil {
+		err = fmt.Errorf("failed to query listeners: %w", err)
+		i.shutdownLocked(err)
+		return nil, err
+	}
+	i.listeners.Store(listeners)
+
+	return t, nil
+}
+
+// Listeners returns the listeners opened by the last Start, or nil if the
+// instance was not started with Start or is not running.
+func (i *Instance) Listeners() *Listeners {
+	return i.listeners.Load()
+}
+
+// QueryListeners asks the running Tor for its listeners, however it was
+// started. Listeners configured as "auto" are reported with the port Tor
+// bound. Listeners are only opened once the network is enabled, so call it
+// after bootstrap. It returns ErrNotRunning if Tor is not running.
+func (i *Instance) QueryListeners() (*Listeners, error) {
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	listeners, err := queryListeners(t.Control)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query listeners: %w", err)
+	}
+	return listeners, nil
+}
+
+// QueryListeners asks the Tor of the default instance for its listeners.
+// See Instance.QueryListeners.
+func QueryListeners() (*Listeners, error) {
+	return defaultInstance.QueryListeners()
+}
+
+// queryListeners asks Tor for its client and control listeners.
+func queryListeners(conn *control.Conn) (*Listeners, error) {
+	l := &Listeners{}
+	lists := []struct {
+		key  string
+		dest *[]string
+	}{
+		{"net/listeners/socks", &l.Socks},
+		{"net/listeners/control", &l.Control},
+		{"net/listeners/dns", &l.DNS},
+		{"net/listeners/trans", &l.Trans},
+		{"net/listeners/httptunnel", &l.HTTPTunnel},
+	}
+	for _, list := range lists {
+		addrs, err := getListenerInfo(conn, list.key)
+		if err != nil {
+			return nil, err
+		}
+		*list.dest = addrs
+	}
+	return l, nil
+}
+
+// getListenerInfo runs GETINFO for a single net/listeners/* key. The raw
+// request is used because control.Conn.GetInfo cannot unquote the
+// space-separated list Tor returns when there is more than one listener.
+func getListenerInfo(conn *control.Conn, key string) ([]string, error) {
+	resp, err := conn.SendRequest("GETINFO %v", key)
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range resp.Data {
+		k, val, _ := torutil.PartitionString(data, '=')
+		if k == key {
+			return parseListenerList(val)
+		}
+	}
+	return nil, nil
+}
+
+// parseListenerList splits a GETINFO net/listeners/* value, a
+// space-separated list of quoted addresses, into its addresses.
+func parseListenerList(val string) ([]string, error) {
+	var addrs []string
+	for val = strings.TrimSpace(val); val != ""; val = strings.TrimSpace(val) {
+		end := strings.IndexByte(val, ' ')
+		if val[0] == '"' {
+			// Find the closing quote, skipping escaped characters
+			end = -1
+			for j := 1; j < len(val); j++ {
+				if val[j] == '\\' {
+					j++
+				} else if val[j] == '"' {
+					end = j + 1
+					break
+				}
+			}
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated listener %q", val)
+			}
+		} else if end == -1 {
+			end = len(val)
+		}
+
+		addr, err := torutil.UnescapeSimpleQuotedStringIfNeeded(val[:end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: %w", val[:end], err)
+		}
+		addrs = append(addrs, addr)
+		val = val[end:]
+	}
+	return addrs, nil
+}
@@ -0,0 +1,129 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/cretz/bine/tor"
+)
+
+func TestParseListenerList(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []string
+	}{
+		{"", nil},
+		{`"127.0.0.1:9050"`, []string{"127.0.0.1:9050"}},
+		{`"127.0.0.1:9050" "[::1]:9050"`, []string{"127.0.0.1:9050", "[::1]:9050"}},
+		{`"unix:/tmp/dir with space/socks"`, []string{"unix:/tmp/dir with space/socks"}},
+		{`127.0.0.1:9051`, []string{"127.0.0.1:9051"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseListenerList(tt.val)
+		if err != nil {
+			t.Errorf("parseListenerList(%q) error: %v", tt.val, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseListenerList(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+
+	if _, err := parseListenerList(`"127.0.0.1:9050`); err == nil {
+		t.Error("Expected error for unterminated listener")
+	}
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	inst := NewInstance()
+	inst.tor.Store(&tor.Tor{})
+	config := DefaultConfig()
+	config.DataDir = filepath.Join(t.TempDir(), "data")
+
+	if _, err := inst.Start(context.Background(), config); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("Expected ErrAlreadyRunning, got %v", err)
+	}
+	if _, err := os.Stat(config.DataDir); !os.IsNotExist(err) {
+		t.Error("Start on a running instance created the data directory")
+	}
+}
+
+func TestPrepareDataDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nested", "data")
+	if err := prepareDataDir(dir); err != nil {
+		t.Fatalf("prepareDataDir failed: %v", err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Data dir not created: %v", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Got mode %v, want 0700", info.Mode().Perm())
+	}
+
+	// A regular file is not a valid data directory
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareDataDir(file); err == nil {
+		t.Error("Expected error for a file used as data dir")
+	}
+
+	if err := prepareDataDir(""); err == nil {
+		t.Error("Expected error for empty data dir")
+	}
+}
+
+func TestPrepareDataDirPermissions(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepareDataDir(dir); err != nil {
+		t.Fatalf("prepareDataDir failed: %v", err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0700 {
+		t.Errorf("Got mode %v, want 0700", info.Mode().Perm())
+	}
+}
+
+func TestDefaultDataDir(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", "/xdg/data")
+	dir := DefaultDataDir()
+	if !filepath.IsAbs(dir) || filepath.Base(dir) != dataDirName {
+		t.Errorf("Unexpected default data dir %q", dir)
+	}
+	if runtime.GOOS == "linux" && dir != "/xdg/data/embedded-tor" {
+		t.Errorf("Got %q, want it under XDG_DATA_HOME", dir)
+	}
+	if DefaultConfig().DataDir != dir {
+		t.Error("Expected DefaultConfig to use DefaultDataDir")
+	}
+}
+
+func TestEphemeralDataDir(t *testing.T) {
+	dir, err := newEphemeralDataDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0700 {
+		t.Errorf("Got mode %v, want 0700", info.Mode().Perm())
+	}
+}
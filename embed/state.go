@@ -0,0 +1,272 @@
+package embed
+
+import (
+	"context"
+	"sync"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+// State is the lifecycle state of an Instance.
+type State int
+
+const (
+	// StateStopped means no Tor is running. It is the initial state.
+	StateStopped State = iota
+	// StateStarting means the Tor process is being launched
+	StateStarting
+	// StateControlReady means Tor is running and the control connection is
+	// authenticated, but the network has not been enabled yet
+	StateControlReady
+	// StateBootstrapping means Tor is connecting to the network
+	StateBootstrapping
+	// StateReady means Tor is bootstrapped and can build circuits
+	StateReady
+	// StateDegraded means Tor was ready but has lost the network, its
+	// directory information or its ability to build circuits
+	StateDegraded
+	// StateStopping means the instance is shutting Tor down
+	StateStopping
+	// StateFailed means Tor failed to start or bootstrap, or exited without
+	// being stopped
+	StateFailed
+)
+
+var stateNames = map[State]string{
+	StateStopped:       "Stopped",
+	StateStarting:      "Starting",
+	StateControlReady:  "ControlReady",
+	StateBootstrapping: "Bootstrapping",
+	StateReady:         "Ready",
+	StateDegraded:      "Degraded",
+	StateStopping:      "Stopping",
+	StateFailed:        "Failed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// StateChange describes a single lifecycle transition.
+type StateChange struct {
+	From State
+	To   State
+
+	// Reason is a short explanation of the transition, such as the Tor
+	// status event that caused it
+	Reason string
+
+	// Err is the cause when To is StateFailed
+	Err error
+}
+
+// stateBufferSize is the per-subscriber channel buffer
+const stateBufferSize = 16
+
+// lifecycle holds an Instance's state and its subscribers.
+type lifecycle struct {
+	mu     sync.Mutex
+	state  State
+	err    error
+	nextID int
+	subs   map[int]chan StateChange
+}
+
+// GetState returns the current lifecycle state of the default instance.
+func GetState() State {
+	return defaultInstance.State()
+}
+
+// State returns the current lifecycle state of the instance.
+func (i *Instance) State() State {
+	i.life.mu.Lock()
+	defer i.life.mu.Unlock()
+	return i.life.state
+}
+
+// Err returns the error that moved the instance to StateFailed, or nil.
+func (i *Instance) Err() error {
+	i.life.mu.Lock()
+	defer i.life.mu.Unlock()
+	return i.life.err
+}
+
+// SubscribeState returns a channel that receives every subsequent state
+// change of the instance and a function that ends the subscription and
+// closes the channel. Changes are dropped for a subscriber whose buffer is
+// full, so slow consumers should call State to resynchronize.
+func (i *Instance) SubscribeState() (<-chan StateChange, func()) {
+	i.life.mu.Lock()
+	defer i.life.mu.Unlock()
+
+	if i.life.subs == nil {
+		i.life.subs = map[int]chan StateChange{}
+	}
+	id := i.life.nextID
+	i.life.nextID++
+	ch := make(chan StateChange, stateBufferSize)
+	i.life.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			i.life.mu.Lock()
+			defer i.life.mu.Unlock()
+			delete(i.life.subs, id)
+			close(ch)
+		})
+	}
+}
+
+// setState moves the instance to the given state and notifies subscribers.
+// Transitions to the current state are ignored.
+func (i *Instance) setState(to State, reason string, err error) {
+	i.life.mu.Lock()
+	defer i.life.mu.Unlock()
+	i.setStateLocked(to, reason, err)
+}
+
+// setStateFor is setState for transitions observed on t. It is ignored if t
+// is no longer the instance's Tor, so a late event from a stopped Tor can't
+// affect a newer one, or if allowed rejects the current state.
+func (i *Instance) setStateFor(t *tor.Tor, allowed func(State) bool, to State, reason string, err error) {
+	i.life.mu.Lock()
+	defer i.life.mu.Unlock()
+	if i.tor.Load() != t || !allowed(i.life.state) {
+		return
+	}
+	i.setStateLocked(to, reason, err)
+}
+
+func (i *Instance) setStateLocked(to State, reason string, err error) {
+	from := i.life.state
+	if from == to {
+		return
+	}
+	i.life.state = to
+	if to == StateFailed {
+		i.life.err = err
+	} else if to == StateStarting {
+		i.life.err = nil
+	}
+
+	change := StateChange{From: from, To: to, Reason: reason, Err: err}
+	for _, ch := range i.life.subs {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// transition is a state change implied by a control event, allowed only
+// from the listed states. Events move a running Tor between its network
+// states; they never override Start, Stop or a failure.
+type transition struct {
+	to     State
+	from   []State
+	reason string
+}
+
+func (tr transition) allowed(s State) bool {
+	for _, from := range tr.from {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// watch follows t's process and control events for as long as its control
+// connection is open, driving the transitions that happen outside of Start
+// and Stop. Transitions are ignored once t is no longer the instance's Tor.
+func (i *Instance) watch(t *tor.Tor) {
+	running := func(s State) bool {
+		return s != StateStopping && s != StateStopped && s != StateFailed
+	}
+
+	// Process exit
+	if p, ok := t.Process.(*watchedProcess); ok {
+		ring := i.logs.Load()
+		go func() {
+			<-p.done
+			err := p.err
+			if exitErr := p.exitError(); exitErr != nil {
+				err = withLogLines(exitErr, ring)
+			}
+			if err == nil {
+				err = ErrUnexpectedExit
+			}
+			i.setStateFor(t, running, StateFailed, "tor process exited", err)
+		}()
+	}
+
+	// Control port events. The listener is never removed: removing it sends
+	// a request that could block on this very channel, so it lives until
+	// the control connection is closed.
+	codes := []control.EventCode{control.EventCodeStatusClient, control.EventCodeNetworkLiveness,
+		control.EventCodeHSDesc}
+	eventCh := make(chan control.Event, 64)
+	if err := t.Control.AddEventListener(eventCh, codes...); err != nil {
+		return
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- t.Control.HandleEvents(context.Background()) }()
+	go func() {
+		for {
+			select {
+			case <-errCh:
+				return
+			case evt := <-eventCh:
+				if hs, ok := evt.(*control.HSDescEvent); ok && i.tor.Load() == t {
+					i.onions.descEvent(hs)
+					continue
+				}
+				if tr, ok := transitionFromEvent(evt); ok {
+					i.setStateFor(t, tr.allowed, tr.to, tr.reason, nil)
+				}
+			}
+		}
+	}()
+}
+
+// transitionFromEvent maps a control event to the transition it implies.
+func transitionFromEvent(evt control.Event) (transition, bool) {
+	recovered := func(reason string) (transition, bool) {
+		return transition{to: StateReady, from: []State{StateDegraded}, reason: reason}, true
+	}
+	degraded := func(reason string) (transition, bool) {
+		return transition{to: StateDegraded, from: []State{StateReady}, reason: reason}, true
+	}
+
+	switch evt := evt.(type) {
+	case *control.StatusEvent:
+		switch evt.Action {
+		case "BOOTSTRAP":
+			args := parseStatusArguments(evt.Raw)
+			if args["PROGRESS"] == "100" {
+				return transition{to: StateReady,
+					from:   []State{StateControlReady, StateBootstrapping, StateDegraded},
+					reason: "bootstrap complete"}, true
+			}
+			return transition{to: StateBootstrapping, from: []State{StateControlReady},
+				reason: "bootstrap " + args["TAG"]}, true
+		case "CIRCUIT_ESTABLISHED", "ENOUGH_DIR_INFO":
+			return recovered(evt.Action)
+		case "CIRCUIT_NOT_ESTABLISHED", "NOT_ENOUGH_DIR_INFO":
+			return degraded(evt.Action)
+		}
+	case *control.NetworkLivenessEvent:
+		switch evt.Raw {
+		case "UP":
+			return recovered("network up")
+		case "DOWN":
+			return degraded("network down")
+		}
+	}
+	return transition{}, false
+}
@@ -0,0 +1,113 @@
+package embed
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+)
+
+func TestStateString(t *testing.T) {
+	if StateReady.String() != "Ready" {
+		t.Errorf("Got %s, want Ready", StateReady)
+	}
+	if State(100).String() != "Unknown" {
+		t.Errorf("Got %s, want Unknown", State(100))
+	}
+}
+
+func TestSubscribeState(t *testing.T) {
+	inst := NewInstance()
+	if inst.State() != StateStopped {
+		t.Fatalf("New instance should be Stopped, got %s", inst.State())
+	}
+
+	changes, cancel := inst.SubscribeState()
+	defer cancel()
+
+	startErr := errors.New("boom")
+	inst.setState(StateStarting, "start requested", nil)
+	inst.setState(StateStarting, "duplicate", nil)
+	inst.setState(StateFailed, "start failed", startErr)
+
+	first := <-changes
+	if first.From != StateStopped || first.To != StateStarting {
+		t.Errorf("Unexpected first change: %+v", first)
+	}
+	second := <-changes
+	if second.To != StateFailed || second.Err != startErr {
+		t.Errorf("Unexpected second change: %+v", second)
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("Duplicate transition should not be reported: %+v", c)
+	default:
+	}
+	if inst.Err() != startErr {
+		t.Errorf("Got err %v, want %v", inst.Err(), startErr)
+	}
+
+	// Cancel closes the channel and is safe to call twice
+	cancel()
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Error("Expected channel to be closed after cancel")
+	}
+}
+
+func TestSetStateForIgnoresStaleTor(t *testing.T) {
+	inst := NewInstance()
+	current := &tor.Tor{}
+	inst.tor.Store(current)
+	inst.setState(StateReady, "", nil)
+
+	degraded := transition{from: []State{StateReady}}
+	inst.setStateFor(&tor.Tor{}, degraded.allowed, StateDegraded, "stale", nil)
+	if inst.State() != StateReady {
+		t.Errorf("Event from stale Tor changed state to %s", inst.State())
+	}
+
+	inst.setStateFor(current, degraded.allowed, StateDegraded, "network down", nil)
+	if inst.State() != StateDegraded {
+		t.Errorf("Got %s, want Degraded", inst.State())
+	}
+}
+
+func TestTransitionFromEvent(t *testing.T) {
+	tests := []struct {
+		evt  control.Event
+		from State
+		to   State
+	}{
+		{control.ParseStatusEvent(control.EventCodeStatusClient,
+			`NOTICE BOOTSTRAP PROGRESS=5 TAG=conn SUMMARY="Connecting to a relay"`), StateControlReady, StateBootstrapping},
+		{control.ParseStatusEvent(control.EventCodeStatusClient,
+			`NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`), StateBootstrapping, StateReady},
+		{control.ParseStatusEvent(control.EventCodeStatusClient, `NOTICE CIRCUIT_NOT_ESTABLISHED REASON=CLOCK_JUMPED`),
+			StateReady, StateDegraded},
+		{control.ParseStatusEvent(control.EventCodeStatusClient, `NOTICE CIRCUIT_ESTABLISHED`), StateDegraded, StateReady},
+		{control.ParseNetworkLivenessEvent("DOWN"), StateReady, StateDegraded},
+		{control.ParseNetworkLivenessEvent("UP"), StateDegraded, StateReady},
+	}
+
+	for _, tt := range tests {
+		tr, ok := transitionFromEvent(tt.evt)
+		if !ok {
+			t.Errorf("No transition for %+v", tt.evt)
+			continue
+		}
+		if tr.to != tt.to || !tr.allowed(tt.from) {
+			t.Errorf("Event %+v: got %s allowed=%v, want %s from %s", tt.evt, tr.to, tr.allowed(tt.from), tt.to, tt.from)
+		}
+		if tr.allowed(StateStopping) {
+			t.Errorf("Event %+v must not leave Stopping", tt.evt)
+		}
+	}
+
+	// Recovery events do not skip bootstrap
+	tr, _ := transitionFromEvent(control.ParseStatusEvent(control.EventCodeStatusClient, `NOTICE ENOUGH_DIR_INFO`))
+	if tr.allowed(StateBootstrapping) {
+		t.Error("ENOUGH_DIR_INFO should not end bootstrapping")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !cgo || systemtor
+// +build !cgo systemtor
+
+package embed
+
+import (
+	"testing"
+
+	"github.com/RelayAnon/tor-static-builder/embed/tor048"
+)
+
+func TestSystemTorBuild(t *testing.T) {
+	if IsEmbedded() {
+		t.Fatal("IsEmbedded should return false without the static libraries")
+	}
+	if tor048.HasRun() {
+		t.Error("A system Tor should never count as having run")
+	}
+
+	inst := NewInstance()
+	if inst.embedded {
+		t.Error("Expected NewInstance to use a control port with the system Tor")
+	}
+}
@@ -0,0 +1,254 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"golang.org/x/net/proxy"
+)
+
+// defaultSocksPort is what Tor listens on when no SocksPort is configured.
+const defaultSocksPort = "9050"
+
+// SocksListener is a SOCKS listener added to a running Tor with
+// AddSocksListener, for example one per tenant. Close removes it again.
+type SocksListener struct {
+	// Port is the listener as requested
+	Port Port
+
+	// Addr is the address Tor bound, such as "127.0.0.1:41325" for an
+	// "auto" port, or "unix:/path" for a unix socket
+	Addr string
+
+	// line is the SocksPort value that keeps this listener, with an auto
+	// port replaced by the bound one
+	line string
+
+	inst *Instance
+}
+
+// Dialer returns a dialer through this listener. auth, if set, is sent as
+// SOCKS username and password, which with IsolateSOCKSAuth separates the
+// circuits of different credentials.
+func (l *SocksListener) Dialer(auth *proxy.Auth) (*tor.Dialer, error) {
+	return socksDialer(l.Addr, auth)
+}
+
+// Close removes the listener from Tor. Streams already open through it are
+// not closed.
+func (l *SocksListener) Close() error {
+	return l.inst.removeSocksListener(l)
+}
+
+// AddSocksListener opens a SOCKS listener on the running Tor without
+// restarting it, keeping the SOCKS listeners it already has. An empty
+// port.Addr is "auto", for which Tor picks a free port on 127.0.0.1; the
+// directory of a unix socket is created as it is by Start. The flags and SessionGroup of port isolate the listener's streams, e.g.
+// IsolateDestAddr, IsolateSOCKSAuth and OnionTrafficOnly. Listeners are
+// removed with Close and when Tor stops, and are kept by Apply. It returns
+// ErrNotRunning if Tor is not running.
+func (i *Instance) AddSocksListener(ctx context.Context, port Port) (*SocksListener, error) {
+	if port.Addr == "" {
+		port.Addr = "auto"
+	}
+	if err := checkPort(port); err != nil {
+		return nil, &ConfigError{Option: "SocksPort", Value: port.String(), Err: err}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := prepareSocketDir(port); err != nil {
+		return nil, err
+	}
+	before, err := getListenerInfo(t.Control, "net/listeners/socks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query listeners: %w", err)
+	}
+
+	l := &SocksListener{Port: port, Addr: port.Addr, line: port.String(), inst: i}
+	if err := i.setSocksListenersLocked(t, append(i.tenants, l), i.tenants); err != nil {
+		return nil, err
+	}
+
+	// Find the address Tor bound
+	after, err := getListenerInfo(t.Control, "net/listeners/socks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query listeners: %w", err)
+	}
+	for _, addr := range after {
+		if !containsString(before, addr) {
+			l.Addr = addr
+			break
+		}
+	}
+	if strings.HasSuffix(l.Addr, "auto") {
+		i.setSocksListenersLocked(t, i.tenants, append(i.tenants, l))
+		return nil, errors.New("tor did not report the new SOCKS listener")
+	}
+	if strings.HasSuffix(port.Addr, "auto") {
+		// Pin the auto port so Tor keeps this listener on later changes
+		bound := port
+		bound.Addr = l.Addr
+		l.line = bound.String()
+		auto := &SocksListener{line: port.String()}
+		if err := i.setSocksListenersLocked(t, append(i.tenants, l), append(i.tenants, auto)); err != nil {
+			i.setSocksListenersLocked(t, i.tenants, append(i.tenants, auto))
+			return nil, err
+		}
+	}
+	i.tenants = append(i.tenants, l)
+	i.refreshListenersLocked(t)
+	return l, nil
+}
+
+// SocksListeners returns the listeners added with AddSocksListener.
+func (i *Instance) SocksListeners() []*SocksListener {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]*SocksListener(nil), i.tenants...)
+}
+
+func (i *Instance) removeSocksListener(l *SocksListener) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var rest []*SocksListener
+	for _, other := range i.tenants {
+		if other != l {
+			rest = append(rest, other)
+		}
+	}
+	if len(rest) == len(i.tenants) {
+		// Already closed, or Tor has stopped
+		return nil
+	}
+	t := i.tor.Load()
+	if t == nil {
+		return ErrNotRunning
+	}
+	if err := i.setSocksListenersLocked(t, rest, i.tenants); err != nil {
+		return err
+	}
+	i.tenants = rest
+	i.refreshListenersLocked(t)
+	return nil
+}
+
+// setSocksListenersLocked sets Tor's SocksPort lines to its own listeners,
+// those not among old, followed by tenants.
+func (i *Instance) setSocksListenersLocked(t *tor.Tor, tenants, old []*SocksListener) error {
+	current, err := getSocksLines(t.Control)
+	if err != nil {
+		return fmt.Errorf("failed to get SocksPort: %w", err)
+	}
+	var own []string
+	for _, line := range current {
+		if !containsLine(old, line) {
+			own = append(own, line)
+		}
+	}
+
+	var entries []*control.KeyVal
+	for _, line := range withTenantLines(own, tenants) {
+		entries = append(entries, control.NewKeyVal("SocksPort", line))
+	}
+	if err := t.Control.SetConf(entries...); err != nil {
+		return fmt.Errorf("failed to set SocksPort: %w", err)
+	}
+	return nil
+}
+
+// withTenantLines returns the SocksPort lines for own listeners plus
+// tenants. A disabled SocksPort ("0") cannot be combined with other
+// listeners, so it is dropped while there are tenants and restored after.
+func withTenantLines(own []string, tenants []*SocksListener) []string {
+	var lines []string
+	for _, line := range own {
+		if len(tenants) == 0 || strings.TrimSpace(line) != "0" {
+			lines = append(lines, line)
+		}
+	}
+	for _, l := range tenants {
+		lines = append(lines, l.line)
+	}
+	if len(lines) == 0 {
+		lines = []string{"0"}
+	}
+	return lines
+}
+
+// getSocksLines returns the configured SocksPort lines. Without any, Tor
+// listens on its default port, which is returned instead.
+func getSocksLines(conn *control.Conn) ([]string, error) {
+	entries, err := conn.GetConf("SocksPort")
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, entry := range entries {
+		if entry.ValSet() {
+			lines = append(lines, entry.Val)
+		}
+	}
+	if len(lines) == 0 {
+		lines = []string{defaultSocksPort}
+	}
+	return lines, nil
+}
+
+// refreshListenersLocked updates the listeners reported by Listeners
+// after a change.
+func (i *Instance) refreshListenersLocked(t *tor.Tor) {
+	if i.listeners.Load() == nil {
+		return
+	}
+	if listeners, err := queryListeners(t.Control); err == nil {
+		i.listeners.Store(listeners)
+	}
+}
+
+func containsLine(tenants []*SocksListener, line string) bool {
+	for _, l := range tenants {
+		if l.line == line {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// socksDialer returns a SOCKS5 dialer for a listener address as reported
+// by GETINFO net/listeners/socks.
+func socksDialer(addr string, auth *proxy.Auth) (*tor.Dialer, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return UnixSocksDialer(addr, auth)
+	}
+	if addr == "" {
+		return nil, errors.New("no SOCKS listener address")
+	}
+	d, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return &tor.Dialer{Dialer: d}, nil
+}
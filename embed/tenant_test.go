@@ -0,0 +1,329 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil"
+)
+
+// fakeControl answers the control commands used to reconfigure a running
+// Tor: GETCONF, SETCONF, RESETCONF and GETINFO net/listeners/socks.
+type fakeControl struct {
+	mu       sync.Mutex
+	commands []string
+	conf     map[string][]string
+	// info are the GETINFO values other than net/listeners/socks
+	info map[string]string
+	// reject makes SETCONF and RESETCONF fail for commands setting one of
+	// these options, leaving the configuration unchanged as Tor does
+	reject map[string]bool
+	// ports are the ports bound for "auto" SocksPort lines
+	ports map[string]int
+}
+
+// newFakeTor returns a Tor whose control connection is answered by a
+// fakeControl with the given configuration.
+func newFakeTor(t *testing.T, conf map[string][]string) (*tor.Tor, *fakeControl) {
+	client, server := net.Pipe()
+	f := &fakeControl{conf: conf, reject: map[string]bool{}, ports: map[string]int{}}
+	go f.serve(textproto.NewConn(server))
+	t.Cleanup(func() { client.Close() })
+	return &tor.Tor{Control: control.NewConn(textproto.NewConn(client))}, f
+}
+
+func (f *fakeControl) serve(conn *textproto.Conn) {
+	defer conn.Close()
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, line)
+		reply := f.handle(line)
+		f.mu.Unlock()
+		if err := conn.PrintfLine("%s", reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeControl) handle(line string) string {
+	cmd, args, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "GETCONF":
+		values := f.conf[args]
+		if len(values) == 0 {
+			return "250 " + args
+		}
+		var lines []string
+		for j, val := range values {
+			sep := "-"
+			if j == len(values)-1 {
+				sep = " "
+			}
+			lines = append(lines, "250"+sep+args+"="+val)
+		}
+		return strings.Join(lines, "\r\n")
+	case "SETCONF", "RESETCONF":
+		entries, err := parseConfArgs(args)
+		if err != nil {
+			return "513 " + err.Error()
+		}
+		for _, entry := range entries {
+			if f.reject[entry.Key] {
+				return "552 Unacceptable option value"
+			}
+		}
+		set := map[string][]string{}
+		for _, entry := range entries {
+			if entry.ValSet() {
+				set[entry.Key] = append(set[entry.Key], entry.Val)
+			} else if _, ok := set[entry.Key]; !ok {
+				set[entry.Key] = nil
+			}
+		}
+		for key, values := range set {
+			if values == nil {
+				delete(f.conf, key)
+			} else {
+				f.conf[key] = values
+			}
+		}
+		return "250 OK"
+	case "GETINFO":
+		if val, ok := f.info[args]; ok {
+			return "250+" + args + "=\r\n" + strings.ReplaceAll(val, "\n", "\r\n") + "\r\n.\r\n250 OK"
+		}
+		if args != "net/listeners/socks" {
+			return "552 Unrecognized key"
+		}
+		var addrs []string
+		for _, addr := range f.socksAddrs() {
+			addrs = append(addrs, `"`+addr+`"`)
+		}
+		return "250-net/listeners/socks=" + strings.Join(addrs, " ") + "\r\n250 OK"
+	}
+	return "510 Unrecognized command"
+}
+
+// socksAddrs returns the addresses of the configured SocksPort lines.
+func (f *fakeControl) socksAddrs() []string {
+	lines := f.conf["SocksPort"]
+	if lines == nil {
+		lines = []string{defaultSocksPort}
+	}
+	var addrs []string
+	for _, line := range lines {
+		addr := strings.Fields(line)[0]
+		switch {
+		case addr == "0":
+			continue
+		case addr == "auto":
+			if f.ports[line] == 0 {
+				f.ports[line] = 41000 + len(f.ports)
+			}
+			addr = fmt.Sprintf("127.0.0.1:%d", f.ports[line])
+		case !strings.Contains(addr, ":"):
+			addr = "127.0.0.1:" + addr
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// lines returns the values of an option.
+func (f *fakeControl) lines(key string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.conf[key]...)
+}
+
+// parseConfArgs parses the arguments of SETCONF and RESETCONF: keys with
+// optional values, quoted if they contain spaces.
+func parseConfArgs(args string) ([]*control.KeyVal, error) {
+	var entries []*control.KeyVal
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		end := strings.IndexAny(args, "= ")
+		if end < 0 || args[end] == ' ' {
+			if end < 0 {
+				end = len(args)
+			}
+			entries = append(entries, &control.KeyVal{Key: args[:end]})
+			args = args[end:]
+			continue
+		}
+		key, rest := args[:end], args[end+1:]
+		valEnd := strings.IndexByte(rest, ' ')
+		if strings.HasPrefix(rest, `"`) {
+			valEnd = -1
+			for j := 1; j < len(rest); j++ {
+				if rest[j] == '\\' {
+					j++
+				} else if rest[j] == '"' {
+					valEnd = j + 1
+					break
+				}
+			}
+			if valEnd < 0 {
+				return nil, fmt.Errorf("unterminated quote in %q", rest)
+			}
+		} else if valEnd < 0 {
+			valEnd = len(rest)
+		}
+		val, err := torutil.UnescapeSimpleQuotedStringIfNeeded(rest[:valEnd])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, control.NewKeyVal(key, val))
+		args = rest[valEnd:]
+	}
+	return entries, nil
+}
+
+func TestWithTenantLines(t *testing.T) {
+	a := &SocksListener{line: "127.0.0.1:41000 IsolateDestAddr"}
+	b := &SocksListener{line: "unix:/run/b/socks SessionGroup=2"}
+	tests := []struct {
+		own     []string
+		tenants []*SocksListener
+		want    []string
+	}{
+		{[]string{"9050"}, []*SocksListener{a}, []string{"9050", a.line}},
+		{[]string{"0"}, []*SocksListener{a, b}, []string{a.line, b.line}},
+		{[]string{"0"}, nil, []string{"0"}},
+		{nil, nil, []string{"0"}},
+	}
+	for _, tt := range tests {
+		if got := withTenantLines(tt.own, tt.tenants); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withTenantLines(%q, %d tenants) = %q, want %q", tt.own, len(tt.tenants), got, tt.want)
+		}
+	}
+}
+
+func TestAddSocksListenerChecks(t *testing.T) {
+	inst := NewInstance()
+	var configErr *ConfigError
+	_, err := inst.AddSocksListener(context.Background(), Port{Flags: []PortFlag{"NoSuchFlag"}})
+	if !errors.As(err, &configErr) {
+		t.Errorf("Expected *ConfigError for an unknown flag, got %v", err)
+	}
+	_, err = inst.AddSocksListener(context.Background(), Port{Flags: []PortFlag{IsolateDestAddr}})
+	if !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Expected ErrNotRunning, got %v", err)
+	}
+	if len(inst.SocksListeners()) != 0 {
+		t.Error("Expected no listeners")
+	}
+}
+
+func TestAddSocksListener(t *testing.T) {
+	tr, f := newFakeTor(t, map[string][]string{"SocksPort": {"9050"}})
+	inst := NewInstance()
+	inst.tor.Store(tr)
+	ctx := context.Background()
+
+	a, err := inst.AddSocksListener(ctx, Port{Flags: []PortFlag{IsolateDestAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Addr != "127.0.0.1:41000" {
+		t.Errorf("Got address %q, want the bound auto port", a.Addr)
+	}
+	b, err := inst.AddSocksListener(ctx, Port{Addr: "9150", Flags: []PortFlag{IsolateSOCKSAuth}, SessionGroup: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"9050", "127.0.0.1:41000 IsolateDestAddr", "9150 IsolateSOCKSAuth SessionGroup=2"}
+	if got := f.lines("SocksPort"); !reflect.DeepEqual(got, want) {
+		t.Errorf("SocksPort = %q, want %q", got, want)
+	}
+	if got := inst.SocksListeners(); len(got) != 2 || got[0] != a || got[1] != b {
+		t.Errorf("Unexpected listeners %v", got)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.lines("SocksPort"); !reflect.DeepEqual(got, []string{"9050", want[2]}) {
+		t.Errorf("SocksPort after Close = %q", got)
+	}
+	// Closing twice does nothing
+	if err := a.Close(); err != nil {
+		t.Error(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.lines("SocksPort"); !reflect.DeepEqual(got, []string{"9050"}) {
+		t.Errorf("SocksPort after closing all = %q", got)
+	}
+}
+
+func TestAddSocksListenerDisabledSocksPort(t *testing.T) {
+	tr, f := newFakeTor(t, map[string][]string{"SocksPort": {"0"}})
+	inst := NewInstance()
+	inst.tor.Store(tr)
+
+	l, err := inst.AddSocksListener(context.Background(), Port{Addr: "9150", Flags: []PortFlag{OnionTrafficOnly}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.lines("SocksPort"); !reflect.DeepEqual(got, []string{"9150 OnionTrafficOnly"}) {
+		t.Errorf("SocksPort = %q, want only the tenant", got)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.lines("SocksPort"); !reflect.DeepEqual(got, []string{"0"}) {
+		t.Errorf("SocksPort after Close = %q, want it disabled again", got)
+	}
+}
+
+func TestAddSocksListenerUnix(t *testing.T) {
+	tr, _ := newFakeTor(t, map[string][]string{"SocksPort": {"9050"}})
+	inst := NewInstance()
+	inst.tor.Store(tr)
+
+	path := filepath.Join(t.TempDir(), "tenants", "a", "socks")
+	l, err := inst.AddSocksListener(context.Background(), Port{Addr: "unix:" + path, Flags: []PortFlag{GroupWritable}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Addr != "unix:"+path {
+		t.Errorf("Got address %q, want the socket", l.Addr)
+	}
+	info, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("Socket directory was not created: %v", err)
+	}
+	if info.Mode().Perm()&^0750 != 0 {
+		t.Errorf("Socket directory mode %o, want at most 0750", info.Mode().Perm())
+	}
+}
+
+func TestAddSocksListenerRejected(t *testing.T) {
+	tr, f := newFakeTor(t, map[string][]string{"SocksPort": {"9050"}})
+	f.reject["SocksPort"] = true
+	inst := NewInstance()
+	inst.tor.Store(tr)
+
+	if _, err := inst.AddSocksListener(context.Background(), Port{}); err == nil {
+		t.Error("Expected an error when Tor rejects the listener")
+	}
+	if len(inst.SocksListeners()) != 0 {
+		t.Error("Rejected listener should not be recorded")
+	}
+}
@@ -0,0 +1,43 @@
+package tor048
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrAlreadyStarted is returned by Start when the process was already
+	// started.
+	ErrAlreadyStarted = errors.New("tor already started")
+
+	// ErrNotStarted is returned by Wait when the process was never started.
+	ErrNotStarted = errors.New("tor not started")
+
+	// ErrCommandLine is returned by Start when Tor rejects the command line.
+	ErrCommandLine = errors.New("failed to set command line args")
+
+	// ErrRestartUnsupported is returned by New and Start once Tor has run in
+	// this process. Tor's embedding API cannot run tor_run_main twice; run
+	// Tor as a child process instead when restarts are needed.
+	ErrRestartUnsupported = errors.New("embedded tor already ran in this process and cannot be restarted")
+)
+
+// ExitError is returned by Wait when tor_run_main returns a non-zero exit
+// code.
+type ExitError struct {
+	// Code is the value returned by tor_run_main
+	Code int
+
+	// LastLogLines holds Tor's most recent log lines, oldest first, when the
+	// caller captured them. It is empty otherwise.
+	LastLogLines []string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("tor exited with code %d", e.Code)
+	if len(e.LastLogLines) > 0 {
+		msg += ": " + strings.Join(e.LastLogLines, "; ")
+	}
+	return msg
+}
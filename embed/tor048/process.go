@@ -1,5 +1,11 @@
+//go:build cgo && !systemtor
+// +build cgo,!systemtor
+
 // Package tor048 implements process interfaces for statically linked
 // Tor 0.4.8.x versions.
+//
+// Building with CGO_ENABLED=0 or the systemtor tag selects a fallback that
+// needs no static libraries and runs the tor executable found in PATH.
 package tor048
 
 import (
@@ -7,6 +13,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/cretz/bine/process"
 )
@@ -85,8 +93,22 @@ static void freeCharArray(char **a, int size) {
 */
 import "C"
 
+// Embedded is true when Tor is statically linked into the binary
+const Embedded = true
+
 type embeddedCreator struct{}
 
+// hasRun is set by the first Start. Tor keeps global state that is not
+// fully reset when tor_run_main returns, so it may only run once per
+// process.
+var hasRun atomic.Bool
+
+// HasRun returns true once an embedded Tor has been started in this
+// process. Any further New or Start returns ErrRestartUnsupported.
+func HasRun() bool {
+	return hasRun.Load()
+}
+
 // ProviderVersion returns the Tor provider name and version exposed from the
 // Tor embedded API.
 func ProviderVersion() string {
@@ -103,73 +125,156 @@ type embeddedProcess struct {
 	ctx      context.Context
 	mainConf *C.struct_tor_main_configuration_t
 	args     []string
-	doneCh   chan int
+
+	// shutdownWait is how long a SIGNAL SHUTDOWN may take before HALT
+	shutdownWait time.Duration
+
+	// shutdownConn is a second owning control connection used to stop Tor
+	// when ctx is done
+	shutdownConn net.Conn
+
+	// done is closed once tor_run_main has returned and the configuration
+	// has been freed; exitCode is set before that
+	done     chan struct{}
+	exitCode int
 }
 
 // New implements process.Creator.New
 func (embeddedCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	if HasRun() {
+		return nil, ErrRestartUnsupported
+	}
 	return &embeddedProcess{
-		ctx:      ctx,
-		mainConf: C.tor_main_configuration_new(),
-		args:     args,
+		ctx:          ctx,
+		mainConf:     C.tor_main_configuration_new(),
+		args:         args,
+		shutdownWait: shutdownWaitFromArgs(args),
 	}, nil
 }
 
 // Start implements process.Process.Start
 func (e *embeddedProcess) Start() error {
-	if e.doneCh != nil {
-		return fmt.Errorf("already started")
+	if e.done != nil {
+		return ErrAlreadyStarted
+	}
+
+	// Tor must know about every control socket before it runs
+	if e.ctx != nil {
+		conn, err := e.EmbeddedControlConn()
+		if err != nil {
+			return err
+		}
+		e.shutdownConn = conn
 	}
-	
+
 	// Create the char array for the args
 	args := append([]string{"tor"}, e.args...)
 	charArray := C.makeCharArray(C.int(len(args)))
 	for i, a := range args {
 		C.setArrayString(charArray, C.CString(a), C.int(i))
 	}
-	
+
 	// Build the conf
 	if code := C.tor_main_configuration_set_command_line(e.mainConf, C.int(len(args)), charArray); code != 0 {
 		C.tor_main_configuration_free(e.mainConf)
 		C.freeCharArray(charArray, C.int(len(args)))
-		return fmt.Errorf("failed to set command line args, code: %v", int(code))
+		if e.shutdownConn != nil {
+			e.shutdownConn.Close()
+		}
+		return fmt.Errorf("%w, code: %v", ErrCommandLine, int(code))
 	}
-	
-	// Run it async
-	e.doneCh = make(chan int, 1)
+
+	// Claim the one run this process gets
+	if !hasRun.CompareAndSwap(false, true) {
+		C.tor_main_configuration_free(e.mainConf)
+		C.freeCharArray(charArray, C.int(len(args)))
+		if e.shutdownConn != nil {
+			e.shutdownConn.Close()
+		}
+		return ErrRestartUnsupported
+	}
+
+	// Run it async. The configuration is freed before done is closed so
+	// Wait never returns while Tor still uses it.
+	e.done = make(chan struct{})
 	go func() {
-		defer C.freeCharArray(charArray, C.int(len(args)))
-		defer C.tor_main_configuration_free(e.mainConf)
-		e.doneCh <- int(C.tor_run_main(e.mainConf))
+		code := int(C.tor_run_main(e.mainConf))
+		C.tor_main_configuration_free(e.mainConf)
+		C.freeCharArray(charArray, C.int(len(args)))
+		e.exitCode = code
+		close(e.done)
 	}()
+	if e.shutdownConn != nil {
+		go e.shutdownOnDone()
+	}
 	return nil
 }
 
-// Wait implements process.Process.Wait
-func (e *embeddedProcess) Wait() error {
-	if e.doneCh == nil {
-		return fmt.Errorf("not started")
+// RunMain runs Tor synchronously in this process with the given
+// command-line arguments, without an embedded control connection, and
+// returns its exit code. It is meant for a process that does nothing but
+// run Tor, such as a child started from the same binary.
+func RunMain(args []string) int {
+	if !hasRun.CompareAndSwap(false, true) {
+		return 1
 	}
-	
-	ctx := e.ctx
-	if ctx == nil {
-		ctx = context.Background()
+
+	mainConf := C.tor_main_configuration_new()
+	defer C.tor_main_configuration_free(mainConf)
+
+	args = append([]string{"tor"}, args...)
+	charArray := C.makeCharArray(C.int(len(args)))
+	defer C.freeCharArray(charArray, C.int(len(args)))
+	for i, a := range args {
+		C.setArrayString(charArray, C.CString(a), C.int(i))
+	}
+
+	if code := C.tor_main_configuration_set_command_line(mainConf, C.int(len(args)), charArray); code != 0 {
+		return int(code)
+	}
+	return int(C.tor_run_main(mainConf))
+}
+
+// shutdownOnDone stops Tor once ctx is done. Tor is asked to SHUTDOWN
+// cleanly, then to HALT if it is still running after shutdownWait, and
+// finally the owning control connection is closed, which makes Tor exit.
+func (e *embeddedProcess) shutdownOnDone() {
+	defer e.shutdownConn.Close()
+
+	select {
+	case <-e.done:
+		return
+	case <-e.ctx.Done():
 	}
-	
+
+	fmt.Fprint(e.shutdownConn, "SIGNAL SHUTDOWN\r\n")
 	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case code := <-e.doneCh:
-		if code == 0 {
-			return nil
-		}
-		return fmt.Errorf("command completed with error exit code: %v", code)
+	case <-e.done:
+		return
+	case <-time.After(e.shutdownWait):
+	}
+	fmt.Fprint(e.shutdownConn, "SIGNAL HALT\r\n")
+}
+
+// Wait implements process.Process.Wait. It returns once tor_run_main has
+// returned and its configuration has been freed; when ctx is done Tor is
+// shut down first rather than left running.
+func (e *embeddedProcess) Wait() error {
+	if e.done == nil {
+		return ErrNotStarted
+	}
+
+	<-e.done
+	if e.exitCode == 0 {
+		return nil
 	}
+	return &ExitError{Code: e.exitCode}
 }
 
 // EmbeddedControlConn implements process.Process.EmbeddedControlConn
 func (e *embeddedProcess) EmbeddedControlConn() (net.Conn, error) {
 	file := os.NewFile(uintptr(C.tor_main_configuration_setup_control_socket(e.mainConf)), "")
+	defer file.Close()
 	conn, err := net.FileConn(file)
 	if err != nil {
 		err = fmt.Errorf("unable to create conn from control socket: %v", err)
@@ -0,0 +1,91 @@
+//go:build !cgo || systemtor
+// +build !cgo systemtor
+
+package tor048
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/cretz/bine/process"
+)
+
+// systemTorPath is the tor executable run in place of the embedded Tor
+const systemTorPath = "tor"
+
+// Embedded is false when the binary was built without the static Tor
+// libraries and runs the system tor executable instead
+const Embedded = false
+
+// HasRun always returns false: a system Tor runs in its own process and can
+// be started any number of times.
+func HasRun() bool {
+	return false
+}
+
+// ProviderVersion returns the version line reported by the system tor
+// executable, or an empty string if it cannot be run.
+func ProviderVersion() string {
+	out, err := exec.Command(systemTorPath, "--version").Output()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSpace(line)
+}
+
+// NewCreator creates a process.Creator that runs the tor executable found in
+// PATH using bine's exec creator.
+func NewCreator() process.Creator {
+	return systemCreator{process.NewCreator(systemTorPath)}
+}
+
+// RunMain runs the system tor executable with the given command-line
+// arguments and the standard streams of this process, and returns its exit
+// code.
+func RunMain(args []string) int {
+	cmd := exec.Command(systemTorPath, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		return 1
+	}
+	return 0
+}
+
+// systemCreator wraps bine's exec creator so exits are reported as
+// *ExitError like the embedded Tor's.
+type systemCreator struct {
+	process.Creator
+}
+
+// New implements process.Creator.New
+func (c systemCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	p, err := c.Creator.New(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return systemProcess{p}, nil
+}
+
+type systemProcess struct {
+	process.Process
+}
+
+// Wait implements process.Process.Wait
+func (p systemProcess) Wait() error {
+	err := p.Process.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{Code: exitErr.ExitCode()}
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+package tor048
+
+import (
+	"strings"
+	"time"
+
+	"github.com/RelayAnon/tor-static-builder/embed/internal/torconf"
+)
+
+const (
+	// defaultShutdownWaitLength is Tor's default ShutdownWaitLength
+	defaultShutdownWaitLength = 30 * time.Second
+
+	// shutdownMargin is added to ShutdownWaitLength before Tor is halted,
+	// giving a clean shutdown time to finish
+	shutdownMargin = 5 * time.Second
+)
+
+// shutdownWaitFromArgs returns how long to wait for a SIGNAL SHUTDOWN to
+// complete before sending HALT, mirroring a --ShutdownWaitLength argument
+// if one is present.
+func shutdownWaitFromArgs(args []string) time.Duration {
+	wait := defaultShutdownWaitLength
+	for i := 0; i+1 < len(args); i++ {
+		if strings.EqualFold(strings.TrimLeft(args[i], "-"), "ShutdownWaitLength") {
+			if d, ok := torconf.ParseInterval(args[i+1]); ok {
+				wait = d
+			}
+		}
+	}
+	return wait + shutdownMargin
+}
@@ -0,0 +1,25 @@
+package tor048
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownWaitFromArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want time.Duration
+	}{
+		{nil, defaultShutdownWaitLength + shutdownMargin},
+		{[]string{"--ShutdownWaitLength", "0"}, shutdownMargin},
+		{[]string{"--SocksPort", "9050", "--ShutdownWaitLength", "10 seconds"}, 10*time.Second + shutdownMargin},
+		{[]string{"--ShutdownWaitLength", "2 minutes"}, 2*time.Minute + shutdownMargin},
+		{[]string{"--ShutdownWaitLength", "bogus"}, defaultShutdownWaitLength + shutdownMargin},
+	}
+
+	for _, tt := range tests {
+		if got := shutdownWaitFromArgs(tt.args); got != tt.want {
+			t.Errorf("shutdownWaitFromArgs(%q) = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
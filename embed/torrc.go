@@ -0,0 +1,509 @@
+package embed
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RelayAnon/tor-static-builder/embed/internal/torconf"
+	"github.com/cretz/bine/torutil"
+)
+
+// maxIncludeDepth mirrors Tor's limit on nested %include directives
+const maxIncludeDepth = 31
+
+// ParseTorrc reads torrc options from r in order. Comments, line
+// continuations and quoted values are handled as Tor does. Relative
+// %include paths are resolved against the current directory.
+func ParseTorrc(r io.Reader) ([]Option, error) {
+	return parseTorrc(r, "torrc", ".", 0)
+}
+
+// LoadTorrc reads the torrc file at path and converts it to a Config.
+// Relative %include paths are resolved against the directory of the file
+// that includes them. Fields that are not Tor options, such as
+// BootstrapTimeout, are left zero.
+func LoadTorrc(path string) (*Config, error) {
+	opts, err := readTorrcFile(path, 0)
+	if err != nil {
+		return nil, err
+	}
+	return ConfigFromOptions(opts)
+}
+
+func readTorrcFile(path string, depth int) ([]Option, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTorrc(f, path, filepath.Dir(path), depth)
+}
+
+func parseTorrc(r io.Reader, name, dir string, depth int) ([]Option, error) {
+	var opts []Option
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	lineNo := 0
+	var logical strings.Builder
+	continued := false
+	for scanner.Scan() {
+		lineNo++
+		// A comment-only line inside a continuation is skipped
+		if continued && strings.HasPrefix(strings.TrimSpace(scanner.Text()), "#") {
+			continue
+		}
+		text := stripTorrcComment(scanner.Text())
+		trimmed := strings.TrimRight(text, " \t")
+		if continued = strings.HasSuffix(trimmed, "\\"); continued {
+			logical.WriteString(strings.TrimSuffix(trimmed, "\\"))
+			continue
+		}
+		logical.WriteString(text)
+		line := strings.TrimSpace(logical.String())
+		logical.Reset()
+		if line == "" {
+			continue
+		}
+
+		key, val := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, val = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if strings.HasPrefix(val, `"`) {
+			unquoted, err := torutil.UnescapeSimpleQuotedString(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w: %v", name, lineNo, ErrInvalidValue, err)
+			}
+			val = unquoted
+		}
+
+		if key == "%include" {
+			included, err := includeTorrc(val, dir, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %w", name, lineNo, err)
+			}
+			opts = append(opts, included...)
+			continue
+		}
+		if strings.HasPrefix(key, "/") {
+			return nil, fmt.Errorf("%s line %d: %w: clearing option %s is not supported",
+				name, lineNo, ErrInvalidValue, key[1:])
+		}
+		key, _ = canonicalOption(strings.TrimPrefix(key, "+"))
+		opts = append(opts, Option{Key: key, Value: val})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return opts, nil
+}
+
+// stripTorrcComment removes a trailing comment from a torrc line, leaving
+// a '#' inside a quoted value alone.
+func stripTorrcComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quoted && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			quoted = !quoted
+		case line[i] == '#' && !quoted:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// includeTorrc reads the files matched by an %include pattern. A directory
+// includes every file in it that does not start with a dot, in lexical
+// order.
+func includeTorrc(pattern, dir string, depth int) ([]Option, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%%include nested more than %d levels", maxIncludeDepth)
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%%include %s: %w", pattern, os.ErrNotExist)
+	}
+	sort.Strings(paths)
+
+	var opts []Option
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{path}
+		if info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			files = files[:0]
+			for _, entry := range entries {
+				if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+		for _, file := range files {
+			included, err := readTorrcFile(file, depth)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, included...)
+		}
+	}
+	return opts, nil
+}
+
+// ConfigFromOptions converts torrc options, such as those returned by
+// ParseTorrc, to a Config. Options without a typed field are kept in
+// Config.Options or, inside a HiddenServiceDir block, in the service's
+// Options. As in Tor, SocksPort is 9050 unless the options set it.
+// Malformed values are reported as *ConfigError values joined into a
+// single error.
+func ConfigFromOptions(opts []Option) (*Config, error) {
+	c := &Config{}
+	var errs []error
+	invalid := func(opt Option, format string, args ...any) {
+		errs = append(errs, &ConfigError{Option: opt.Key, Value: opt.Value,
+			Err: fmt.Errorf("%w: "+format, append([]any{ErrInvalidValue}, args...)...)})
+	}
+	boolean := func(opt Option) bool {
+		switch opt.Value {
+		case "0":
+			return false
+		case "1":
+			return true
+		}
+		invalid(opt, "must be 0 or 1")
+		return false
+	}
+	nodes := func(val string) []string {
+		var list []string
+		for _, node := range strings.Split(val, ",") {
+			list = append(list, strings.TrimSpace(node))
+		}
+		return list
+	}
+
+	var service *OnionServiceConfig
+	socksSet := false
+	for _, opt := range opts {
+		key, _ := canonicalOption(opt.Key)
+		opt.Key = key
+		val := opt.Value
+
+		if perServiceOptions[key] && service == nil {
+			invalid(opt, "must follow a HiddenServiceDir")
+			continue
+		}
+
+		switch key {
+		case "DataDirectory":
+			c.DataDir = val
+		case "SocksPort":
+			if n, err := strconv.Atoi(val); err == nil && !socksSet {
+				c.SocksPort = n
+			} else if val == "auto" && !socksSet {
+				c.SocksPort = AutoPort
+			} else {
+				c.SocksPorts = append(c.SocksPorts, parsePort(val))
+			}
+			socksSet = true
+		case "ControlPort":
+			// The first numeric port is ControlPort, the rest are listed
+			// in ControlPorts; port 0 disables the control port
+			if n, err := strconv.Atoi(val); err == nil && n == 0 {
+				c.ControlPort = DisabledPort
+			} else if err == nil && c.ControlPort == 0 {
+				c.ControlPort = n
+			} else {
+				c.ControlPorts = append(c.ControlPorts, parsePort(val))
+			}
+		case "DNSPort":
+			c.DNSPorts = append(c.DNSPorts, parsePort(val))
+		case "TransPort":
+			c.TransPorts = append(c.TransPorts, parsePort(val))
+		case "HTTPTunnelPort":
+			c.HTTPTunnelPorts = append(c.HTTPTunnelPorts, parsePort(val))
+		case "ClientOnly":
+			c.ClientOnly = boolean(opt)
+		case "ShutdownWaitLength":
+			if d, ok := torconf.ParseInterval(val); ok {
+				c.ShutdownWait = d
+			} else {
+				invalid(opt, "must be a time interval")
+			}
+
+		case "EntryNodes":
+			c.Nodes.EntryNodes = nodes(val)
+		case "MiddleNodes":
+			c.Nodes.MiddleNodes = nodes(val)
+		case "ExitNodes":
+			c.Nodes.ExitNodes = nodes(val)
+		case "ExcludeNodes":
+			c.Nodes.ExcludeNodes = nodes(val)
+		case "ExcludeExitNodes":
+			c.Nodes.ExcludeExitNodes = nodes(val)
+		case "StrictNodes":
+			c.Nodes.StrictNodes = boolean(opt)
+
+		case "UseBridges":
+			// Implied by Bridges.Lines
+			boolean(opt)
+		case "Bridge":
+			c.Bridges.Lines = append(c.Bridges.Lines, val)
+		case "ClientTransportPlugin":
+			fields := strings.Fields(val)
+			if len(fields) < 3 || fields[1] != "exec" {
+				invalid(opt, "only \"transports exec path [args]\" plugins are supported")
+				continue
+			}
+			c.Bridges.Transports = append(c.Bridges.Transports, TransportPlugin{
+				Names: strings.Split(fields[0], ","), Path: fields[2], Args: fields[3:]})
+
+		case "HTTPSProxy":
+			c.Proxy.HTTPS = val
+		case "HTTPSProxyAuthenticator":
+			c.Proxy.HTTPSAuthenticator = val
+		case "Socks4Proxy":
+			c.Proxy.Socks4 = val
+		case "Socks5Proxy":
+			c.Proxy.Socks5 = val
+		case "Socks5ProxyUsername":
+			c.Proxy.Socks5Username = val
+		case "Socks5ProxyPassword":
+			c.Proxy.Socks5Password = val
+
+		case "BandwidthRate", "BandwidthBurst":
+			n, err := parseBytes(val)
+			if err != nil {
+				invalid(opt, "%v", err)
+			} else if key == "BandwidthRate" {
+				c.Bandwidth.Rate = n
+			} else {
+				c.Bandwidth.Burst = n
+			}
+
+		case "CacheDirectory":
+			c.Directory.CacheDirectory = val
+		case "DirAuthority":
+			c.Directory.DirAuthorities = append(c.Directory.DirAuthorities, val)
+		case "FallbackDir":
+			c.Directory.FallbackDirs = append(c.Directory.FallbackDirs, val)
+		case "FetchDirInfoEarly":
+			c.Directory.FetchDirInfoEarly = boolean(opt)
+		case "FetchDirInfoExtraEarly":
+			c.Directory.FetchDirInfoExtraEarly = boolean(opt)
+		case "FetchUselessDescriptors":
+			c.Directory.FetchUselessDescriptors = boolean(opt)
+		case "DownloadExtraInfo":
+			c.Directory.DownloadExtraInfo = boolean(opt)
+		case "AvoidDiskWrites":
+			c.Directory.AvoidDiskWrites = boolean(opt)
+
+		case "Log":
+			severity, target, _ := strings.Cut(val, " ")
+			c.Logs = append(c.Logs, LogConfig{Severity: severity, Target: strings.TrimSpace(target)})
+
+		case "HiddenServiceDir":
+			c.OnionServices = append(c.OnionServices, OnionServiceConfig{Dir: val})
+			service = &c.OnionServices[len(c.OnionServices)-1]
+		case "HiddenServiceVersion":
+			if val != "3" {
+				invalid(opt, "only version 3 onion services are supported")
+			}
+		case "HiddenServicePort":
+			virtual, target, _ := strings.Cut(val, " ")
+			n, err := strconv.Atoi(virtual)
+			if err != nil {
+				invalid(opt, "virtual port must be a number")
+				continue
+			}
+			service.Ports = append(service.Ports, OnionPort{Virtual: n, Target: strings.TrimSpace(target)})
+		case "HiddenServiceMaxStreams", "HiddenServiceNumIntroductionPoints":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				invalid(opt, "must be a number")
+			} else if key == "HiddenServiceMaxStreams" {
+				service.MaxStreams = n
+			} else {
+				service.NumIntroductionPoints = n
+			}
+		case "HiddenServiceMaxStreamsCloseCircuit":
+			service.MaxStreamsCloseCircuit = boolean(opt)
+		case "HiddenServiceAllowUnknownPorts":
+			service.AllowUnknownPorts = boolean(opt)
+
+		default:
+			if perServiceOptions[key] {
+				service.Options = append(service.Options, opt)
+			} else {
+				c.Options = append(c.Options, opt)
+			}
+		}
+	}
+
+	// A plain "ControlPort auto" is ControlPort 0 when alone, AutoPort
+	// alongside other control listeners
+	for j, p := range c.ControlPorts {
+		if c.ControlPort == 0 && p.String() == "auto" {
+			c.ControlPorts = append(c.ControlPorts[:j], c.ControlPorts[j+1:]...)
+			if len(c.ControlPorts) == 0 {
+				c.ControlPorts = nil
+			} else {
+				c.ControlPort = AutoPort
+			}
+			break
+		}
+	}
+	// Without a SocksPort line Tor listens on its default port, not none
+	if !socksSet {
+		c.SocksPort, _ = strconv.Atoi(defaultSocksPort)
+	}
+	return c, errors.Join(errs...)
+}
+
+// parsePort parses a listener value such as "9050 IsolateDestAddr
+// SessionGroup=1" or `unix:"/path with spaces" GroupWritable`.
+func parsePort(val string) Port {
+	p := Port{}
+	val = strings.TrimSpace(val)
+	if path, ok := strings.CutPrefix(val, `unix:"`); ok {
+		// A quoted socket path may contain spaces
+		end := -1
+		for j := 0; j < len(path); j++ {
+			if path[j] == '\\' {
+				j++
+			} else if path[j] == '"' {
+				end = j
+				break
+			}
+		}
+		if end >= 0 {
+			if unquoted, err := torutil.UnescapeSimpleQuotedString(`"` + path[:end+1]); err == nil {
+				p.Addr = "unix:" + unquoted
+				val = path[end+1:]
+			}
+		}
+	}
+	fields := strings.Fields(val)
+	if p.Addr == "" {
+		if len(fields) == 0 {
+			return p
+		}
+		p.Addr, fields = fields[0], fields[1:]
+	}
+	for _, field := range fields {
+		if group, ok := strings.CutPrefix(field, "SessionGroup="); ok {
+			if n, err := strconv.Atoi(group); err == nil {
+				p.SessionGroup = n
+				continue
+			}
+		}
+		p.Flags = append(p.Flags, PortFlag(field))
+	}
+	return p
+}
+
+// byteUnits are the torrc memory units, in bytes
+var byteUnits = map[string]float64{
+	"": 1, "b": 1, "byte": 1, "bytes": 1,
+	"kb": 1 << 10, "kbyte": 1 << 10, "kbytes": 1 << 10, "kilobyte": 1 << 10, "kilobytes": 1 << 10,
+	"mb": 1 << 20, "mbyte": 1 << 20, "mbytes": 1 << 20, "megabyte": 1 << 20, "megabytes": 1 << 20,
+	"gb": 1 << 30, "gbyte": 1 << 30, "gbytes": 1 << 30, "gigabyte": 1 << 30, "gigabytes": 1 << 30,
+	"tb": 1 << 40, "tbyte": 1 << 40, "tbytes": 1 << 40, "terabyte": 1 << 40, "terabytes": 1 << 40,
+	"kbit": 1 << 7, "kbits": 1 << 7, "kilobit": 1 << 7, "kilobits": 1 << 7,
+	"mbit": 1 << 17, "mbits": 1 << 17, "megabit": 1 << 17, "megabits": 1 << 17,
+	"gbit": 1 << 27, "gbits": 1 << 27, "gigabit": 1 << 27, "gigabits": 1 << 27,
+	"tbit": 1 << 37, "tbits": 1 << 37, "terabit": 1 << 37, "terabits": 1 << 37,
+}
+
+// parseBytes parses a torrc memory value such as "100 KBytes" or "1.5 MB".
+func parseBytes(val string) (int64, error) {
+	fields := strings.Fields(val)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, fmt.Errorf("must be a number with an optional unit")
+	}
+	n, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("must be a non-negative number")
+	}
+	unit := ""
+	if len(fields) == 2 {
+		unit = strings.ToLower(fields[1])
+	}
+	scale, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", fields[1])
+	}
+	return int64(math.Round(n * scale)), nil
+}
+
+// WriteTorrc writes the configuration to w in torrc format, starting with
+// its DataDirectory. Fields that are not Tor options, such as
+// BootstrapTimeout or Logger, are not written. LoadTorrc reads the result
+// back into an equivalent Config.
+func (c *Config) WriteTorrc(w io.Writer) error {
+	var b strings.Builder
+	if c.DataDir != "" {
+		writeTorrcLine(&b, Option{Key: "DataDirectory", Value: c.DataDir})
+	}
+	for _, opt := range c.TorOptions() {
+		if opt.Key == "HiddenServiceDir" && b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		writeTorrcLine(&b, opt)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeTorrcLine writes a single option, quoting values that would
+// otherwise be misread.
+func writeTorrcLine(b *strings.Builder, opt Option) {
+	val := opt.Value
+	if strings.ContainsAny(val, "#\"\n\r") || strings.HasSuffix(val, "\\") || strings.TrimSpace(val) != val {
+		val = torutil.EscapeSimpleQuotedString(val)
+	}
+	fmt.Fprintf(b, "%s %s\n", opt.Key, val)
+}
+
+// DumpConfig writes the configuration of the running Tor in torrc format,
+// as reported by GETINFO config-text, including options set at runtime.
+func (i *Instance) DumpConfig(w io.Writer) error {
+	t := i.tor.Load()
+	if t == nil {
+		return ErrNotRunning
+	}
+	info, err := t.Control.GetInfo("config-text")
+	if err != nil {
+		return fmt.Errorf("failed to get config: %w", err)
+	}
+	for _, kv := range info {
+		if kv.Key == "config-text" {
+			text := strings.ReplaceAll(strings.Trim(kv.Val, "\r\n"), "\r\n", "\n")
+			_, err = io.WriteString(w, text+"\n")
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package embed
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTorrc(t *testing.T) {
+	torrc := `# Client settings
+socksport 9050   # lower-case names are canonicalized
+SocksPort 127.0.0.1:9150 IsolateDestAddr \
+    SessionGroup=3
+ExitNodes {de},\
+# comments inside a continuation are skipped
+  {nl}
+ContactInfo "ops # team"
++Log notice stderr
+`
+	opts, err := ParseTorrc(strings.NewReader(torrc))
+	if err != nil {
+		t.Fatalf("ParseTorrc failed: %v", err)
+	}
+	want := []Option{
+		{"SocksPort", "9050"},
+		{"SocksPort", "127.0.0.1:9150 IsolateDestAddr     SessionGroup=3"},
+		{"ExitNodes", "{de},  {nl}"},
+		{"ContactInfo", "ops # team"},
+		{"Log", "notice stderr"},
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("ParseTorrc() =\n%q\nwant\n%q", opts, want)
+	}
+}
+
+func TestLoadTorrcIncludesAndServices(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("torrc", "DataDirectory /var/lib/tor\n%include torrc.d\nClientOnly 1\n")
+	write("torrc.d/10-services", `HiddenServiceDir /var/lib/tor/web
+HiddenServicePort 80 127.0.0.1:8080
+HiddenServicePort 443 127.0.0.1:8443
+HiddenServiceEnableIntroDoSDefense 1
+
+HiddenServiceDir /var/lib/tor/ssh
+HiddenServicePort 22
+`)
+	write("torrc.d/.hidden", "SocksPort 1\n")
+
+	config, err := LoadTorrc(filepath.Join(dir, "torrc"))
+	if err != nil {
+		t.Fatalf("LoadTorrc failed: %v", err)
+	}
+	if config.DataDir != "/var/lib/tor" || !config.ClientOnly || config.SocksPort != 9050 {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if len(config.OnionServices) != 2 {
+		t.Fatalf("Expected 2 services, got %+v", config.OnionServices)
+	}
+	web := config.OnionServices[0]
+	if len(web.Ports) != 2 || web.Ports[1] != (OnionPort{Virtual: 443, Target: "127.0.0.1:8443"}) {
+		t.Errorf("Unexpected web service ports: %+v", web.Ports)
+	}
+	if len(web.Options) != 1 || web.Options[0].Key != "HiddenServiceEnableIntroDoSDefense" {
+		t.Errorf("Expected per-service option on web service, got %+v", web.Options)
+	}
+	if ssh := config.OnionServices[1]; ssh.Dir != "/var/lib/tor/ssh" || len(ssh.Ports) != 1 {
+		t.Errorf("Unexpected ssh service: %+v", ssh)
+	}
+}
+
+func TestTorrcRoundTrip(t *testing.T) {
+	config := &Config{
+		DataDir:      "/var/lib/tor",
+		SocksPort:    9050,
+		SocksPorts:   []Port{{Addr: "9150", Flags: []PortFlag{OnionTrafficOnly}, SessionGroup: 1}},
+		ControlPort:  9051,
+		ClientOnly:   true,
+		ShutdownWait: 10 * time.Second,
+		Nodes:        NodeConfig{ExcludeNodes: []string{"{ru}"}, StrictNodes: true},
+		Bridges: BridgeConfig{
+			Lines:      []string{"snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72"},
+			Transports: []TransportPlugin{{Names: []string{"snowflake"}, Path: "/usr/bin/snowflake-client", Args: []string{"-log", "sf.log"}}},
+		},
+		Proxy:     ProxyConfig{Socks5: "127.0.0.1:1080", Socks5Username: "user", Socks5Password: "p#ss"},
+		Bandwidth: BandwidthConfig{Rate: 512 << 10},
+		Logs:      []LogConfig{{Severity: "notice", Target: "file /var/log/tor/notices.log"}},
+		Directory: DirectoryConfig{AvoidDiskWrites: true},
+		OnionServices: []OnionServiceConfig{
+			{Dir: "/var/lib/tor/web", Ports: []OnionPort{{Virtual: 80, Target: "unix:/run/web.sock"}}, NumIntroductionPoints: 5},
+		},
+		Options: []Option{{"CircuitBuildTimeout", "30"}},
+	}
+
+	var b strings.Builder
+	if err := config.WriteTorrc(&b); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "torrc")
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTorrc(path)
+	if err != nil {
+		t.Fatalf("LoadTorrc failed: %v\n%s", err, b.String())
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Errorf("Round trip mismatch:\n%+v\nwant\n%+v\ntorrc:\n%s", loaded, config, b.String())
+	}
+}
+
+func TestConfigFromOptionsSocksPort(t *testing.T) {
+	tests := []struct {
+		opts  []Option
+		port  int
+		ports int
+	}{
+		{nil, 9050, 0},
+		{[]Option{{"SocksPort", "0"}}, 0, 0},
+		{[]Option{{"SocksPort", "auto"}}, AutoPort, 0},
+		{[]Option{{"SocksPort", "127.0.0.1:9150"}}, 0, 1},
+	}
+	for _, tt := range tests {
+		config, err := ConfigFromOptions(tt.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.SocksPort != tt.port || len(config.SocksPorts) != tt.ports {
+			t.Errorf("ConfigFromOptions(%v): SocksPort %d, SocksPorts %v", tt.opts, config.SocksPort, config.SocksPorts)
+		}
+	}
+}
+
+func TestTorrcControlPortDisabled(t *testing.T) {
+	config, err := ConfigFromOptions([]Option{{"ControlPort", "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ControlPort != DisabledPort || len(config.ControlPorts) != 0 {
+		t.Fatalf("ControlPort %d, ControlPorts %v", config.ControlPort, config.ControlPorts)
+	}
+	if err := config.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := config.WriteTorrc(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "ControlPort 0\n") || strings.Contains(b.String(), "ControlPort auto") {
+		t.Errorf("Unexpected torrc:\n%s", b.String())
+	}
+	loaded, err := ParseTorrc(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ConfigFromOptions(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ControlPort != DisabledPort {
+		t.Errorf("Reloaded ControlPort %d, want DisabledPort", again.ControlPort)
+	}
+
+	config.ControlPorts = []Port{{Addr: "unix:/run/tor/control"}}
+	if err := config.Check(); !errors.Is(err, ErrConflictingOptions) {
+		t.Errorf("Got %v, want ErrConflictingOptions", err)
+	}
+}
+
+func TestParseTorrcErrors(t *testing.T) {
+	if _, err := ParseTorrc(strings.NewReader("%include /does/not/exist\n")); err == nil {
+		t.Error("Expected error for a missing include")
+	}
+	if _, err := ConfigFromOptions([]Option{{"HiddenServicePort", "80"}}); err == nil {
+		t.Error("Expected error for HiddenServicePort outside a service block")
+	}
+	if _, err := ConfigFromOptions([]Option{{"BandwidthRate", "1 parsec"}}); err == nil {
+		t.Error("Expected error for an unknown bandwidth unit")
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	tests := map[string]int64{
+		"100":         100,
+		"100 KBytes":  100 << 10,
+		"1.5 MB":      3 << 19,
+		"8 mbits":     1 << 20,
+		"1 gigabytes": 1 << 30,
+	}
+	for val, want := range tests {
+		if got, err := parseBytes(val); err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d", val, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cretz/bine/tor"
+	"golang.org/x/net/proxy"
+)
+
+// UnixSocksDialer returns a dialer that connects through the Tor SOCKS5
+// proxy listening on the unix socket at path, such as a SocksPort of
+// "unix:/run/myapp/tor/socks". The "unix:" prefix is optional. auth, if
+// set, is sent as SOCKS username and password, which with
+// IsolateSOCKSAuth puts streams with different credentials on different
+// circuits.
+func UnixSocksDialer(path string, auth *proxy.Auth) (*tor.Dialer, error) {
+	path = strings.TrimPrefix(path, "unix:")
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+	d, err := proxy.SOCKS5("unix", path, auth, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return &tor.Dialer{Dialer: d}, nil
+}
+
+// SocksDialer returns a dialer through one of the SOCKS listeners of the
+// running Tor, preferring a unix socket over TCP. Unlike
+// tor.Tor.Dialer it does not enable the network and works with any number
+// of listeners. It returns ErrNotRunning if Tor is not running.
+func (i *Instance) SocksDialer(auth *proxy.Auth) (*tor.Dialer, error) {
+	t := i.tor.Load()
+	if t == nil {
+		return nil, ErrNotRunning
+	}
+	listeners := i.listeners.Load()
+	if listeners == nil {
+		var err error
+		if listeners, err = queryListeners(t.Control); err != nil {
+			return nil, fmt.Errorf("failed to query listeners: %w", err)
+		}
+	}
+	if len(listeners.Socks) == 0 {
+		return nil, errors.New("tor has no SOCKS listener")
+	}
+	for _, addr := range listeners.Socks {
+		if strings.HasPrefix(addr, "unix:") {
+			return UnixSocksDialer(addr, auth)
+		}
+	}
+	return socksDialer(listeners.Socks[0], auth)
+}
+
+// prepareSocketDirs creates the directories of the unix socket listeners in
+// config.
+func prepareSocketDirs(config *Config) error {
+	lists := [][]Port{config.SocksPorts, config.ControlPorts, config.DNSPorts,
+		config.TransPorts, config.HTTPTunnelPorts}
+	for _, list := range lists {
+		for _, p := range list {
+			if err := prepareSocketDir(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepareSocketDir creates the directory of p if it is a unix socket. Tor
+// does not create it and refuses directories others can access, unless the
+// listener is GroupWritable or RelaxDirModeCheck.
+func prepareSocketDir(p Port) error {
+	path, ok := strings.CutPrefix(p.Addr, "unix:")
+	if !ok {
+		return nil
+	}
+	mode := os.FileMode(0700)
+	for _, flag := range p.Flags {
+		if base, negated, _ := portFlagBase(string(flag)); base == string(GroupWritable) && !negated {
+			mode = 0750
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), mode); err != nil {
+		return fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	return nil
+}
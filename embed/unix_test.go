@@ -0,0 +1,111 @@
+package embed
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnixSocketListeners(t *testing.T) {
+	config := DefaultConfig()
+	config.SocksPort = 0
+	config.SocksPorts = []Port{{Addr: "unix:/run/my app/socks", Flags: []PortFlag{GroupWritable, IsolateDestAddr}}}
+	config.ControlPorts = []Port{{Addr: "unix:/run/my app/control", Flags: []PortFlag{WorldWritable}}}
+	args, err := config.Args()
+	if err != nil {
+		t.Fatalf("Args failed: %v", err)
+	}
+	want := []string{
+		"--SocksPort", `unix:"/run/my app/socks" GroupWritable IsolateDestAddr`,
+		"--ControlPort", `unix:"/run/my app/control" WorldWritable`,
+		"--ClientOnly", "1",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("Args() = %q, want %q", args, want)
+	}
+
+	var b strings.Builder
+	if err := config.WriteTorrc(&b); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := ParseTorrc(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ConfigFromOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.SocksPorts, config.SocksPorts) || !reflect.DeepEqual(loaded.ControlPorts, config.ControlPorts) {
+		t.Errorf("Round trip mismatch: %+v %+v\ntorrc:\n%s", loaded.SocksPorts, loaded.ControlPorts, b.String())
+	}
+
+	config.ControlPorts = []Port{{Addr: "unix:/run/control", Flags: []PortFlag{IsolateDestAddr}}}
+	if err := config.Check(); !errors.Is(err, ErrConflictingOptions) {
+		t.Errorf("Expected SOCKS flags on a control listener to be rejected, got %v", err)
+	}
+}
+
+func TestUnixSocksDialer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "socks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "socks")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	defer l.Close()
+
+	// A minimal SOCKS5 server that records the target and echoes
+	target := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		io.ReadFull(conn, buf[:buf[1]])
+		conn.Write([]byte{5, 0})
+		if _, err := io.ReadFull(conn, buf[:5]); err != nil || buf[3] != 3 {
+			return
+		}
+		host := make([]byte, buf[4])
+		io.ReadFull(conn, host)
+		io.ReadFull(conn, buf[:2])
+		target <- string(host)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		io.Copy(conn, conn)
+	}()
+
+	d, err := UnixSocksDialer("unix:"+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("tcp", "example.onion:80")
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if got := <-target; got != "example.onion" {
+		t.Errorf("Proxy got target %q, want example.onion", got)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("Got %q, %v through the proxy", reply, err)
+	}
+}
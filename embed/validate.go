@@ -0,0 +1,243 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/RelayAnon/tor-static-builder/embed/internal/torconf"
+	"github.com/cretz/bine/control"
+)
+
+// optionTypes are the value types of common options, as named by GETINFO
+// config/names. They are used by Validate when no Tor is running to report
+// them.
+var optionTypes = map[string]string{
+	// Booleans
+	"AllowNonRFC953Hostnames": "Boolean", "AutomapHostsOnResolve": "Boolean",
+	"AvoidDiskWrites": "Boolean", "CircuitPadding": "Boolean",
+	"ClientDNSRejectInternalAddresses": "Boolean", "ClientOnly": "Boolean",
+	"ClientRejectInternalAddresses": "Boolean", "ClientUseIPv4": "Boolean",
+	"ClientUseIPv6": "Boolean", "CookieAuthentication": "Boolean",
+	"DisableAllSwap": "Boolean", "DisableDebuggerAttachment": "Boolean",
+	"DisableNetwork": "Boolean", "DormantCanceledByStartup": "Boolean",
+	"DormantOnFirstStartup": "Boolean", "DormantTimeoutDisabledByIdleStreams": "Boolean",
+	"DormantTimeoutEnabled": "Boolean", "DownloadExtraInfo": "Boolean",
+	"EnforceDistinctSubnets": "Boolean", "FascistFirewall": "Boolean",
+	"FetchDirInfoEarly": "Boolean", "FetchDirInfoExtraEarly": "Boolean",
+	"FetchHidServDescriptors": "Boolean", "FetchServerDescriptors": "Boolean",
+	"FetchUselessDescriptors": "Boolean", "HardwareAccel": "Boolean",
+	"LearnCircuitBuildTimeout": "Boolean", "PublishHidServDescriptors": "Boolean",
+	"ReducedCircuitPadding": "Boolean", "ReducedConnectionPadding": "Boolean",
+	"RunAsDaemon": "Boolean", "SafeSocks": "Boolean", "Sandbox": "Boolean",
+	"StrictNodes": "Boolean", "TestSocks": "Boolean", "TruncateLogFile": "Boolean",
+	"UseBridges": "Boolean", "UseDefaultFallbackDirs": "Boolean",
+	"UseEntryGuards": "Boolean", "WarnUnsafeSocks": "Boolean",
+	"HiddenServiceSingleHopMode": "Boolean", "HiddenServiceNonAnonymousMode": "Boolean",
+
+	// Booleans that also accept "auto"
+	"ClientPreferIPv6DirPort": "Autobool", "ClientPreferIPv6ORPort": "Autobool",
+	"ConfluxEnabled": "Autobool", "ConnectionPadding": "Autobool",
+	"ExitRelay": "Autobool", "ExtendByEd25519ID": "Autobool",
+	"GeoIPExcludeUnknown": "Autobool", "KeepBindCapabilities": "Autobool",
+	"UseMicrodescriptors": "Autobool", "VanguardsLiteEnabled": "Autobool",
+
+	// Time intervals
+	"CircuitBuildTimeout": "TimeInterval", "CircuitsAvailableTimeout": "TimeInterval",
+	"CircuitStreamTimeout": "TimeInterval", "DormantClientTimeout": "TimeInterval",
+	"GuardLifetime": "TimeInterval", "HeartbeatPeriod": "TimeInterval",
+	"KeepalivePeriod": "TimeInterval", "MaxCircuitDirtiness": "TimeInterval",
+	"NewCircuitPeriod": "TimeInterval", "ShutdownWaitLength": "TimeInterval",
+	"SocksTimeout": "TimeInterval", "TrackHostExitsExpire": "TimeInterval",
+
+	// Data sizes
+	"AccountingMax": "DataSize", "BandwidthBurst": "DataSize",
+	"BandwidthRate": "DataSize", "ConstrainedSockSize": "DataSize",
+	"MaxAdvertisedBandwidth": "DataSize", "MaxMemInQueues": "DataSize",
+	"PerConnBWBurst": "DataSize", "PerConnBWRate": "DataSize",
+	"RelayBandwidthBurst": "DataSize", "RelayBandwidthRate": "DataSize",
+
+	// Numbers
+	"ConnLimit": "Integer", "MaxClientCircuitsPending": "Integer",
+	"NumCPUs": "Integer", "NumDirectoryGuards": "Integer",
+	"NumEntryGuards": "Integer", "NumPrimaryGuards": "Integer",
+	"CircuitPriorityHalflife": "Float", "PathsNeededToBuildCircuits": "Float",
+}
+
+// Validate checks config on the default instance. See Instance.Validate.
+func Validate(ctx context.Context, config *Config) ([]*ConfigError, error) {
+	return defaultInstance.Validate(ctx, config)
+}
+
+// Validate checks config the way Tor would, without starting it, and
+// returns one *ConfigError per problem; an empty result means the
+// configuration is valid. Besides Config.Check, option names and value
+// types are checked against GETINFO config/names of the running Tor, or a
+// built-in list when the instance is not running. An instance that runs
+// Tor as a separate process also runs tor --verify-config, which catches
+// everything Tor itself rejects. The error is non-nil only if Tor could not
+// be consulted.
+func (i *Instance) Validate(ctx context.Context, config *Config) ([]*ConfigError, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	diags := configErrors(config.Check())
+
+	types := optionTypes
+	t := i.tor.Load()
+	if t != nil {
+		var err error
+		if types, err = getOptionTypes(t.Control.GetInfo); err != nil {
+			return diags, fmt.Errorf("failed to get option names: %w", err)
+		}
+	}
+	for _, opt := range config.TorOptions() {
+		if d := checkOptionType(opt, types, t != nil); d != nil && !hasDiagnostic(diags, d) {
+			diags = append(diags, d)
+		}
+	}
+
+	// The in-process Tor can only run once, so only a separate process can
+	// verify the configuration
+	if i.embedded || len(diags) > 0 {
+		return diags, nil
+	}
+	if d, err := i.verifyConfig(ctx, config); err != nil {
+		return diags, err
+	} else if d != nil {
+		diags = append(diags, d)
+	}
+	return diags, nil
+}
+
+// configErrors flattens the joined errors returned by Config.Check.
+func configErrors(err error) []*ConfigError {
+	var diags []*ConfigError
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		for _, e := range joined.Unwrap() {
+			diags = append(diags, configErrors(e)...)
+		}
+		return diags
+	}
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		diags = append(diags, configErr)
+	}
+	return diags
+}
+
+func hasDiagnostic(diags []*ConfigError, d *ConfigError) bool {
+	for _, existing := range diags {
+		if strings.EqualFold(existing.Option, d.Option) && errors.Is(existing.Err, ErrUnknownOption) == errors.Is(d.Err, ErrUnknownOption) {
+			return true
+		}
+	}
+	return false
+}
+
+// getOptionTypes reads option names and types from GETINFO config/names,
+// a list of "Name Type" lines.
+func getOptionTypes(getInfo func(...string) ([]*control.KeyVal, error)) (map[string]string, error) {
+	info, err := getInfo("config/names")
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, kv := range info {
+		if kv.Key != "config/names" {
+			continue
+		}
+		for _, line := range strings.Split(kv.Val, "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 {
+				types[fields[0]] = fields[1]
+			}
+		}
+	}
+	if len(types) == 0 {
+		return nil, errors.New("empty config/names")
+	}
+	return types, nil
+}
+
+// checkOptionType checks an option's value against its type. With
+// complete set, types lists every option Tor knows and unlisted options are
+// reported as unknown.
+func checkOptionType(opt Option, types map[string]string, complete bool) *ConfigError {
+	typ, ok := types[opt.Key]
+	if !ok {
+		for name, t := range types {
+			if strings.EqualFold(name, opt.Key) {
+				typ, ok = t, true
+				break
+			}
+		}
+	}
+	if !ok {
+		if complete && !strings.HasPrefix(opt.Key, "__") {
+			return &ConfigError{Option: opt.Key, Value: opt.Value, Err: ErrUnknownOption}
+		}
+		return nil
+	}
+
+	var bad bool
+	switch typ {
+	case "Boolean":
+		bad = opt.Value != "0" && opt.Value != "1"
+	case "Autobool":
+		bad = opt.Value != "0" && opt.Value != "1" && opt.Value != "auto"
+	case "Integer", "SignedInteger":
+		_, err := strconv.Atoi(opt.Value)
+		bad = err != nil
+	case "Port":
+		n, err := strconv.Atoi(opt.Value)
+		bad = opt.Value != "auto" && (err != nil || n < 0 || n > 65535)
+	case "Float":
+		_, err := strconv.ParseFloat(opt.Value, 64)
+		bad = err != nil
+	case "TimeInterval":
+		_, ok := torconf.ParseInterval(opt.Value)
+		bad = !ok
+	case "DataSize", "MemUnit":
+		_, err := parseBytes(opt.Value)
+		bad = err != nil
+	default:
+		return nil
+	}
+	if bad {
+		return &ConfigError{Option: opt.Key, Value: opt.Value,
+			Err: fmt.Errorf("%w: expected a %s", ErrInvalidValue, typ)}
+	}
+	return nil
+}
+
+// verifyConfig runs Tor with --verify-config through the instance's
+// creator. Tor prints the reasons for a rejection to its console.
+func (i *Instance) verifyConfig(ctx context.Context, config *Config) (*ConfigError, error) {
+	args := append([]string{"--verify-config", "--hush"}, config.BuildExtraArgs()...)
+	if config.DataDir != "" {
+		args = append(args, "--DataDirectory", config.DataDir)
+	}
+	p, err := i.creator.New(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+	err = p.Wait()
+	code := -1
+	var exitErr *ExitError
+	var cmdErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.Code
+	} else if errors.As(err, &cmdErr) {
+		code = cmdErr.ExitCode()
+	} else {
+		return nil, err
+	}
+	return &ConfigError{Err: fmt.Errorf("%w: tor --verify-config exited with code %d", ErrInvalidValue, code)}, nil
+}
@@ -0,0 +1,105 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/cretz/bine/control"
+	"github.com/cretz/bine/process"
+)
+
+type verifyCreator struct {
+	args []string
+	err  error
+}
+
+func (c *verifyCreator) New(ctx context.Context, args ...string) (process.Process, error) {
+	c.args = args
+	return verifyProcess{c.err}, nil
+}
+
+type verifyProcess struct{ err error }
+
+func (p verifyProcess) Start() error { return nil }
+func (p verifyProcess) Wait() error  { return p.err }
+func (p verifyProcess) EmbeddedControlConn() (net.Conn, error) {
+	return nil, process.ErrControlConnUnsupported
+}
+
+func TestCheckOptionType(t *testing.T) {
+	tests := []struct {
+		opt      Option
+		complete bool
+		want     error
+	}{
+		{Option{"ClientOnly", "1"}, false, nil},
+		{Option{"ClientOnly", "yes"}, false, ErrInvalidValue},
+		{Option{"clientonly", "2"}, false, ErrInvalidValue},
+		{Option{"ConnectionPadding", "auto"}, false, nil},
+		{Option{"MaxCircuitDirtiness", "10 minutes"}, false, nil},
+		{Option{"MaxCircuitDirtiness", "1 month"}, false, nil},
+		{Option{"MaxCircuitDirtiness", "10 fortnights"}, false, ErrInvalidValue},
+		{Option{"BandwidthRate", "1 MBytes"}, false, nil},
+		{Option{"BandwidthRate", "lots"}, false, ErrInvalidValue},
+		{Option{"PathsNeededToBuildCircuits", "0.6"}, false, nil},
+		{Option{"NoSuchOption", "1"}, false, nil},
+		{Option{"NoSuchOption", "1"}, true, ErrUnknownOption},
+		{Option{"__OwningControllerProcess", "1"}, true, nil},
+	}
+	for _, tt := range tests {
+		d := checkOptionType(tt.opt, optionTypes, tt.complete)
+		if tt.want == nil && d != nil {
+			t.Errorf("checkOptionType(%v) = %v, want nil", tt.opt, d)
+		} else if tt.want != nil && (d == nil || !errors.Is(d, tt.want)) {
+			t.Errorf("checkOptionType(%v) = %v, want %v", tt.opt, d, tt.want)
+		}
+	}
+}
+
+func TestGetOptionTypes(t *testing.T) {
+	getInfo := func(keys ...string) ([]*control.KeyVal, error) {
+		return []*control.KeyVal{{Key: "config/names", Val: "ClientOnly Boolean\nSocksPort LineList\n"}}, nil
+	}
+	types, err := getOptionTypes(getInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) != 2 || types["ClientOnly"] != "Boolean" || types["SocksPort"] != "LineList" {
+		t.Errorf("Unexpected types: %v", types)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	creator := &verifyCreator{}
+	inst := NewInstanceWithCreator(creator)
+	diags, err := inst.Validate(context.Background(), DefaultConfig())
+	if err != nil || len(diags) != 0 {
+		t.Fatalf("Expected valid default config, got %v, %v", diags, err)
+	}
+	if len(creator.args) == 0 || creator.args[0] != "--verify-config" {
+		t.Errorf("Expected tor --verify-config, got %q", creator.args)
+	}
+
+	config := DefaultConfig()
+	config.SocksPort = 70000
+	config.Options = []Option{{"MaxCircuitDirtiness", "soon"}}
+	creator.args = nil
+	diags, err = inst.Validate(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 2 || diags[0].Option != "SocksPort" || diags[1].Option != "MaxCircuitDirtiness" {
+		t.Errorf("Unexpected diagnostics: %v", diags)
+	}
+	if creator.args != nil {
+		t.Error("Expected no tor --verify-config run for an invalid config")
+	}
+
+	creator.err = &ExitError{Code: 1}
+	diags, err = inst.Validate(context.Background(), DefaultConfig())
+	if err != nil || len(diags) != 1 || !errors.Is(diags[0], ErrInvalidValue) {
+		t.Errorf("Expected a verify-config diagnostic, got %v, %v", diags, err)
+	}
+}
@@ -3,14 +3,12 @@ package main
 
 import (
 	"context"
-	"crypto/ed25519"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"syscall"
 	"time"
 
@@ -18,29 +16,6 @@ import (
 	"github.com/cretz/bine/tor"
 )
 
-// loadOrCreateKey loads an existing ed25519 key or creates a new one
-func loadOrCreateKey(keyPath string) (ed25519.PrivateKey, bool, error) {
-	// Try to load existing key
-	if keyData, err := os.ReadFile(keyPath); err == nil {
-		if len(keyData) == ed25519.PrivateKeySize {
-			return ed25519.PrivateKey(keyData), true, nil
-		}
-	}
-	
-	// Generate new key
-	_, privKey, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		return nil, false, err
-	}
-	
-	// Save key as raw bytes
-	if err := os.WriteFile(keyPath, privKey, 0600); err != nil {
-		return nil, false, err
-	}
-	
-	return privKey, false, nil
-}
-
 func main() {
 	fmt.Println("Starting onion service example...")
 
@@ -52,13 +27,19 @@ func main() {
 	fmt.Println("Starting embedded Tor...")
 	config := embed.DefaultConfig()
 	config.DataDir = "./tor-data"
-	
-	// Create data directory if it doesn't exist
-	if err := os.MkdirAll(config.DataDir, 0700); err != nil {
-		log.Fatalf("Failed to create data directory: %v", err)
+
+	// Keep the onion service key in the data directory, encrypted if a
+	// passphrase is given. The unencrypted key file is the one earlier
+	// versions of this example wrote, so their address is kept.
+	keyName := "onion_key"
+	config.KeyStore = embed.NewFileKeyStore(config.DataDir)
+	if passphrase := os.Getenv("ONION_KEY_PASSPHRASE"); passphrase != "" {
+		keyName = "onion_key.enc"
+		config.KeyStore = embed.NewEncryptedKeyStore(config.DataDir, []byte(passphrase))
 	}
 	
-	t, err := embed.StartTorWithBootstrap(ctx, config.DataDir, config.BootstrapTimeout)
+	// Start creates the data directory if it doesn't exist
+	t, err := embed.Start(ctx, config)
 	if err != nil {
 		log.Fatalf("Failed to start Tor: %v", err)
 	}
@@ -73,36 +54,18 @@ func main() {
 		fmt.Fprintf(w, "Your path: %s\n", r.URL.Path)
 	})
 
-	// Load or create persistent key
-	keyDir := "./tor-data"
-	if err := os.MkdirAll(keyDir, 0700); err != nil {
-		log.Fatalf("Failed to create key directory: %v", err)
-	}
-	
-	keyPath := filepath.Join(keyDir, "onion_key")
-	privKey, isExisting, err := loadOrCreateKey(keyPath)
-	if err != nil {
-		log.Fatalf("Failed to load/create key: %v", err)
-	}
-	
-	if isExisting {
-		fmt.Println("✓ Using existing onion service key (address will remain the same)")
-	} else {
-		fmt.Println("✓ Created new onion service key (address will persist across restarts)")
-	}
-	
-	// Create onion service with persistent key
-	onion, err := t.Listen(ctx, &tor.ListenConf{
+	// Create onion service with a persistent key, loaded from the key store
+	// or generated and saved on the first run. embed.ListenPersistent
+	// records it in the instance's onion service registry.
+	onion, err := embed.ListenPersistent(ctx, keyName, &tor.ListenConf{
 		RemotePorts: []int{80},
 		Version3:    true,
-		Key:         privKey,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create onion service: %v", err)
 	}
 
-	onionAddr := fmt.Sprintf("%s.onion", onion.ID)
-	embed.SetOnionAddress(onionAddr)
+	onionAddr := embed.GetOnionAddress()
 
 	fmt.Println("========================================")
 	fmt.Printf("Onion service is running!\n")
@@ -2,10 +2,11 @@ module github.com/RelayAnon/tor-static-builder
 
 go 1.24.5
 
-require github.com/cretz/bine v0.2.0
-
 require (
-	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a // indirect
-	golang.org/x/net v0.0.0-20210525063256-abc453219eb5 // indirect
-	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+	filippo.io/edwards25519 v1.1.1
+	github.com/cretz/bine v0.2.0
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 )
+
+require golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect